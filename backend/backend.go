@@ -1,7 +1,48 @@
 // Package backend provides the K/V store interface for crypt backends.
 package backend
 
-import "context"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrVersionMismatch is returned by CompareAndSet when the stored value is
+// not at the expected version.
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// ErrTTLNotSupported is returned when a value with a TTL is set on a store
+// that can't expire keys.
+var ErrTTLNotSupported = errors.New("backend does not support TTLs")
+
+// ErrLeaseNotSupported is returned when a lease is requested from a store
+// that has no leases.
+var ErrLeaseNotSupported = errors.New("backend does not support leases")
+
+// ErrNotFound is matched, using errors.Is, by the errors stores return
+// for keys that do not exist.
+var ErrNotFound = errors.New("key was not found")
+
+// NotFound returns the error for the missing key, which matches
+// ErrNotFound.
+func NotFound(key string) error {
+	return notFoundError(key)
+}
+
+type notFoundError string
+
+func (e notFoundError) Error() string {
+	return fmt.Sprintf("key ( %s ) was not found", string(e))
+}
+
+func (e notFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// Version is an opaque revision of a stored value. Its format depends on
+// the backend. The empty Version stands for a key that does not exist.
+type Version string
 
 // Response represents a response from a backend store.
 type Response struct {
@@ -17,6 +58,99 @@ type KVPair struct {
 
 type KVPairs []*KVPair
 
+// EventType describes the kind of change reported in an Event.
+type EventType int
+
+const (
+	// EventPut is reported when a key is created or updated.
+	EventPut EventType = iota
+	// EventDelete is reported when a key is removed.
+	EventDelete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "PUT"
+	case EventDelete:
+		return "DELETE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Event represents a change of a single key observed by WatchPrefix.
+type Event struct {
+	Type  EventType
+	Key   string
+	Value []byte
+	Error error
+}
+
+// Revision is a previous value of a key as returned by History. Index
+// identifies the revision within the history of the key.
+type Revision struct {
+	Index int64
+	Value []byte
+}
+
+// HistoryStore is a Store which keeps the previous values of its keys.
+type HistoryStore interface {
+	Store
+
+	// History returns up to limit previous values of key, newest first.
+	History(ctx context.Context, key string, limit int) ([]*Revision, error)
+}
+
+// HistoryKeyStore is a Store whose keys can't hold the history rings
+// crypt keeps for stores without a history of their own, key@history/head
+// and key@history/N.
+type HistoryKeyStore interface {
+	Store
+
+	// HistoryKey returns the key of slot, "head" or the number of a
+	// revision, of the history ring of key. An empty key means key can't
+	// have a history ring, so its history isn't recorded.
+	HistoryKey(key, slot string) string
+
+	// IsHistoryKey reports whether key belongs to a history ring.
+	IsHistoryKey(key string) bool
+}
+
+// TTLStore is a Store which can expire keys. An expired key is reported by
+// Watch and WatchPrefix like a removed one.
+type TTLStore interface {
+	Store
+
+	// SetWithTTL sets the provided key to value and removes it once ttl
+	// has passed.
+	SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// LeaseStore is a Store which can attach keys to a lease, so they are
+// removed when their owner goes away.
+type LeaseStore interface {
+	Store
+
+	// Lease grants a lease of ttl which is kept alive until ctx is done
+	// and revoked then.
+	Lease(ctx context.Context, ttl time.Duration) (Lease, error)
+}
+
+// Lease keeps the keys attached to it for as long as it is alive. The keys
+// are removed once the lease is revoked or expires.
+type Lease interface {
+	// Set sets the provided key to value and attaches it to the lease.
+	Set(ctx context.Context, key string, value []byte) error
+
+	// Revoke ends the lease and removes its keys.
+	Revoke(ctx context.Context) error
+
+	// Done is closed when the lease is no longer kept alive, because its
+	// context is done or the keepalives failed.
+	Done() <-chan struct{}
+}
+
 // A Store is a K/V store backend that retrieves and sets, and monitors
 // data in a K/V store.
 type Store interface {
@@ -26,8 +160,26 @@ type Store interface {
 	// Set sets the provided key to value.
 	Set(ctx context.Context, key string, value []byte) error
 
+	// GetWithVersion retrieves a value and its current version for the
+	// provided key.
+	GetWithVersion(ctx context.Context, key string) ([]byte, Version, error)
+
+	// CompareAndSet sets the provided key to value only if the stored value
+	// is still at version expected, and returns ErrVersionMismatch
+	// otherwise. An empty expected version only creates missing keys.
+	CompareAndSet(ctx context.Context, key string, value []byte, expected Version) error
+
+	// Delete removes the provided key.
+	Delete(ctx context.Context, key string) error
+
+	// List retrieves all keys and values under a provided prefix.
+	List(ctx context.Context, prefix string) (KVPairs, error)
+
 	// Watch monitors a K/V store for changes to key.
 	Watch(ctx context.Context, key string) <-chan *Response
+
+	// WatchPrefix monitors a K/V store for changes to all keys under prefix.
+	WatchPrefix(ctx context.Context, prefix string) <-chan *Event
 }
 
 
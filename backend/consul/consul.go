@@ -2,9 +2,13 @@ package consul
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/GGXXLL/crypt/backend"
@@ -12,45 +16,166 @@ import (
 	"github.com/hashicorp/consul/api"
 )
 
+const (
+	minRetryBackoff = 500 * time.Millisecond
+	maxRetryBackoff = 30 * time.Second
+
+	// ttlSessionName is the name of the sessions created by SetWithTTL.
+	ttlSessionName = "crypt-ttl"
+)
+
 type Client struct {
-	client        *api.KV
-	cache         *sync.Map
+	clients       []*api.Client
+	current       uint32
 	watchInterval time.Duration
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+
+	token      string
+	datacenter string
+	namespace  string
+	partition  string
+	tlsConfig  *tls.Config
 }
 
 type OptionFunc func(client *Client)
 
+// WithWatchInterval sets the maximum duration a blocking query used by
+// Watch and WatchPrefix waits for a change before it is reissued.
 func WithWatchInterval(duration time.Duration) OptionFunc {
 	return func(client *Client) {
 		client.watchInterval = duration
 	}
 }
 
-func New(machines []string, opts ...OptionFunc) (*Client, error) {
-	conf := api.DefaultConfig()
-	if len(machines) > 0 {
-		conf.Address = machines[0]
+// WithToken sets the ACL token of the requests, CONSUL_HTTP_TOKEN by
+// default.
+func WithToken(token string) OptionFunc {
+	return func(client *Client) {
+		client.token = token
 	}
-	client, err := api.NewClient(conf)
-	if err != nil {
-		return nil, err
+}
+
+// WithDatacenter sets the datacenter of the requests, the datacenter of
+// the agent by default.
+func WithDatacenter(datacenter string) OptionFunc {
+	return func(client *Client) {
+		client.datacenter = datacenter
 	}
+}
 
-	cli := &Client{client: client.KV(), cache: &sync.Map{}, watchInterval: 10 * time.Second}
+// WithNamespace sets the Consul Enterprise namespace of the keys.
+func WithNamespace(namespace string) OptionFunc {
+	return func(client *Client) {
+		client.namespace = namespace
+	}
+}
+
+// WithPartition sets the Consul Enterprise admin partition of the keys.
+func WithPartition(partition string) OptionFunc {
+	return func(client *Client) {
+		client.partition = partition
+	}
+}
+
+// WithTLS connects to the agents over HTTPS, with a client certificate if
+// tlsConfig has one.
+func WithTLS(tlsConfig *tls.Config) OptionFunc {
+	return func(client *Client) {
+		client.tlsConfig = tlsConfig
+	}
+}
+
+// New creates a client for the agents at machines. Requests go to the
+// first agent until it can't be reached, then they fail over to the next.
+func New(machines []string, opts ...OptionFunc) (*Client, error) {
+	cli := &Client{
+		watchInterval: 10 * time.Second,
+		minBackoff:    minRetryBackoff,
+		maxBackoff:    maxRetryBackoff,
+	}
 	for _, opt := range opts {
 		opt(cli)
 	}
+	if len(machines) == 0 {
+		// the address of api.DefaultConfig
+		machines = []string{""}
+	}
+	for _, machine := range machines {
+		client, err := api.NewClient(cli.config(machine))
+		if err != nil {
+			return nil, err
+		}
+		cli.clients = append(cli.clients, client)
+	}
 
 	return cli, nil
 }
 
+func (c *Client) config(address string) *api.Config {
+	conf := api.DefaultConfig()
+	if address != "" {
+		conf.Address = address
+	}
+	if c.token != "" {
+		conf.Token = c.token
+	}
+	if c.datacenter != "" {
+		conf.Datacenter = c.datacenter
+	}
+	if c.namespace != "" {
+		conf.Namespace = c.namespace
+	}
+	if c.partition != "" {
+		conf.Partition = c.partition
+	}
+	if c.tlsConfig != nil {
+		conf.Scheme = "https"
+		conf.Transport.TLSClientConfig = c.tlsConfig.Clone()
+	}
+	return conf
+}
+
+// do calls fn with the KV endpoint of the current agent. If the agent
+// can't be reached, fn is retried with the next agents.
+func (c *Client) do(fn func(kv *api.KV) error) error {
+	return c.doClient(func(client *api.Client) error {
+		return fn(client.KV())
+	})
+}
+
+// doClient is like do for requests to other endpoints than KV.
+func (c *Client) doClient(fn func(client *api.Client) error) error {
+	var err error
+	for range c.clients {
+		i := atomic.LoadUint32(&c.current)
+		err = fn(c.clients[i])
+		if !unreachable(err) {
+			return err
+		}
+		atomic.CompareAndSwapUint32(&c.current, i, (i+1)%uint32(len(c.clients)))
+	}
+	return err
+}
+
+// unreachable reports whether err is a transport error rather than an
+// error answered by the agent or a canceled request.
+func unreachable(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
 func (c *Client) Get(_ context.Context, key string) ([]byte, error) {
-	kv, _, err := c.client.Get(key, nil)
+	var kv *api.KVPair
+	err := c.do(func(client *api.KV) (err error) {
+		kv, _, err = client.Get(key, nil)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	if kv == nil {
-		return nil, fmt.Errorf("key ( %s ) was not found", key)
+		return nil, backend.NotFound(key)
 	}
 	return kv.Value, nil
 }
@@ -61,30 +186,262 @@ func (c *Client) Set(_ context.Context, key string, value []byte) error {
 		Key:   key,
 		Value: value,
 	}
-	_, err := c.client.Put(kv, nil)
+	return c.do(func(client *api.KV) error {
+		_, err := client.Put(kv, nil)
+		return err
+	})
+}
+
+// SetWithTTL creates a session of ttl which deletes the keys it holds when
+// it is invalidated, and acquires key with it. A key still held by the
+// session of an earlier SetWithTTL is released first. Consul only accepts
+// TTLs from 10s to 24h and may remove the key up to twice the TTL later.
+// A later Set keeps the expiry, call Delete or SetWithTTL to change it.
+func (c *Client) SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	key = strings.TrimPrefix(key, "/")
+	return c.doClient(func(client *api.Client) error {
+		return setWithTTL(ctx, client, key, value, ttl)
+	})
+}
+
+func setWithTTL(ctx context.Context, client *api.Client, key string, value []byte, ttl time.Duration) error {
+	opts := (&api.WriteOptions{}).WithContext(ctx)
+	id, _, err := client.Session().CreateNoChecks(&api.SessionEntry{
+		Name:     ttlSessionName,
+		TTL:      ttl.String(),
+		Behavior: api.SessionBehaviorDelete,
+		// the key may be acquired again right after it expired
+		LockDelay: time.Millisecond,
+	}, opts)
+	if err != nil {
+		return err
+	}
+	kv := &api.KVPair{Key: key, Value: value, Session: id}
+	ok, _, err := client.KV().Acquire(kv, opts)
+	if err == nil && !ok {
+		if err = releaseTTL(ctx, client, key, value); err == nil {
+			ok, _, err = client.KV().Acquire(kv, opts)
+		}
+		if err == nil && !ok {
+			err = fmt.Errorf("key ( %s ) is locked by another session", key)
+		}
+	}
+	if err != nil {
+		client.Session().Destroy(id, opts)
+	}
+	return err
+}
+
+// releaseTTL releases key from the session of an earlier SetWithTTL. Keys
+// locked by other sessions are left alone.
+func releaseTTL(ctx context.Context, client *api.Client, key string, value []byte) error {
+	kv, _, err := client.KV().Get(key, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil || kv == nil || kv.Session == "" {
+		return err
+	}
+	session, _, err := client.Session().Info(kv.Session, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	if session != nil && session.Name != ttlSessionName {
+		return fmt.Errorf("key ( %s ) is locked by another session", key)
+	}
+	_, _, err = client.KV().Release(&api.KVPair{Key: key, Value: value, Session: kv.Session}, (&api.WriteOptions{}).WithContext(ctx))
 	return err
 }
 
+// GetWithVersion returns the value of key together with its ModifyIndex.
+func (c *Client) GetWithVersion(_ context.Context, key string) ([]byte, backend.Version, error) {
+	var kv *api.KVPair
+	err := c.do(func(client *api.KV) (err error) {
+		kv, _, err = client.Get(key, nil)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if kv == nil {
+		return nil, "", backend.NotFound(key)
+	}
+	return kv.Value, backend.Version(strconv.FormatUint(kv.ModifyIndex, 10)), nil
+}
+
+// CompareAndSet uses a check-and-set put guarded by the ModifyIndex of key.
+func (c *Client) CompareAndSet(_ context.Context, key string, value []byte, expected backend.Version) error {
+	kv := &api.KVPair{
+		Key:   strings.TrimPrefix(key, "/"),
+		Value: value,
+	}
+	if expected != "" {
+		index, err := strconv.ParseUint(string(expected), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid consul version %q: %v", expected, err)
+		}
+		kv.ModifyIndex = index
+	}
+	var ok bool
+	err := c.do(func(client *api.KV) (err error) {
+		ok, _, err = client.CAS(kv, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return backend.ErrVersionMismatch
+	}
+	return nil
+}
+
+func (c *Client) Delete(_ context.Context, key string) error {
+	key = strings.TrimPrefix(key, "/")
+	return c.do(func(client *api.KV) error {
+		_, err := client.Delete(key, nil)
+		return err
+	})
+}
+
+func (c *Client) List(ctx context.Context, prefix string) (backend.KVPairs, error) {
+	list, _, err := c.list(ctx, prefix, 0)
+	return list, err
+}
+
+// get reads the pair stored at key together with the consul index of the
+// result. A non-zero waitIndex turns the request into a blocking query.
+func (c *Client) get(ctx context.Context, key string, waitIndex uint64) (*api.KVPair, uint64, error) {
+	var kv *api.KVPair
+	var meta *api.QueryMeta
+	err := c.do(func(client *api.KV) (err error) {
+		kv, meta, err = client.Get(key, c.queryOptions(ctx, waitIndex))
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return kv, meta.LastIndex, nil
+}
+
+// list returns the pairs under prefix together with the consul index of
+// the result. A non-zero waitIndex turns the request into a blocking query.
+func (c *Client) list(ctx context.Context, prefix string, waitIndex uint64) (backend.KVPairs, uint64, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	var kvs api.KVPairs
+	var meta *api.QueryMeta
+	err := c.do(func(client *api.KV) (err error) {
+		kvs, meta, err = client.List(prefix, c.queryOptions(ctx, waitIndex))
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	list := make(backend.KVPairs, 0, len(kvs))
+	for _, kv := range kvs {
+		list = append(list, &backend.KVPair{Key: kv.Key, Value: kv.Value})
+	}
+	return list, meta.LastIndex, nil
+}
+
+func (c *Client) queryOptions(ctx context.Context, waitIndex uint64) *api.QueryOptions {
+	opts := &api.QueryOptions{}
+	if waitIndex > 0 {
+		opts.WaitIndex = waitIndex
+		opts.WaitTime = c.watchInterval
+	}
+	return opts.WithContext(ctx)
+}
+
+// Watch uses consul blocking queries to report changes of key as soon as
+// its ModifyIndex moves. Removal of the key is reported as an error. Failed
+// queries are retried with an exponential backoff.
 func (c *Client) Watch(ctx context.Context, key string) <-chan *backend.Response {
 	respChan := make(chan *backend.Response, 0)
+	kv, waitIndex, err := c.get(ctx, key, 0)
+	var modifyIndex uint64
+	if kv != nil {
+		modifyIndex = kv.ModifyIndex
+	}
 	go func() {
-		defer func() {
-			close(respChan)
-		}()
+		defer close(respChan)
+		var delay time.Duration
 		for {
-			select {
-			case <-time.After(c.watchInterval):
-				val, err := c.Get(ctx, key)
-				if err != nil {
-					respChan <- &backend.Response{Error: err}
-					continue
+			if err != nil {
+				respChan <- &backend.Response{Error: err}
+				delay = internal.Backoff(delay, c.minBackoff, c.maxBackoff)
+				if !internal.Sleep(ctx, delay) {
+					respChan <- &backend.Response{Error: ctx.Err()}
+					return
 				}
-				internal.WatchCache(c.cache, key, val, respChan)
-			case <-ctx.Done():
+			}
+
+			var index uint64
+			kv, index, err = c.get(ctx, key, waitIndex)
+			if ctx.Err() != nil {
 				respChan <- &backend.Response{Error: ctx.Err()}
 				return
 			}
+			if err != nil {
+				continue
+			}
+			delay = 0
+			waitIndex = nextWaitIndex(waitIndex, index)
+
+			switch {
+			case kv == nil && modifyIndex != 0:
+				modifyIndex = 0
+				respChan <- &backend.Response{Error: backend.NotFound(key)}
+			case kv != nil && kv.ModifyIndex != modifyIndex:
+				modifyIndex = kv.ModifyIndex
+				respChan <- &backend.Response{Value: kv.Value}
+			}
 		}
 	}()
 	return respChan
 }
+
+// WatchPrefix uses consul blocking queries on the KV list endpoint to
+// report changes under prefix.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string) <-chan *backend.Event {
+	eventChan := make(chan *backend.Event, 0)
+	list, waitIndex, err := c.list(ctx, prefix, 0)
+	cache := internal.NewPrefixCache(list)
+	go func() {
+		defer close(eventChan)
+		var delay time.Duration
+		for {
+			if err != nil {
+				eventChan <- &backend.Event{Error: err}
+				delay = internal.Backoff(delay, c.minBackoff, c.maxBackoff)
+				if !internal.Sleep(ctx, delay) {
+					eventChan <- &backend.Event{Error: ctx.Err()}
+					return
+				}
+			}
+
+			var index uint64
+			list, index, err = c.list(ctx, prefix, waitIndex)
+			if ctx.Err() != nil {
+				eventChan <- &backend.Event{Error: ctx.Err()}
+				return
+			}
+			if err != nil {
+				continue
+			}
+			delay = 0
+			waitIndex = nextWaitIndex(waitIndex, index)
+
+			internal.WatchPrefixCache(cache, list, eventChan)
+		}
+	}()
+	return eventChan
+}
+
+// nextWaitIndex returns the index for the next blocking query. The index is
+// reset if it went backwards and is at least 1, as a wait index of 0 doesn't
+// block, see
+// https://www.consul.io/api-docs/features/blocking#implementation-details
+func nextWaitIndex(prev, index uint64) uint64 {
+	if index < prev || index < 1 {
+		return 1
+	}
+	return index
+}
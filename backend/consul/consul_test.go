@@ -2,12 +2,20 @@ package consul
 
 import (
 	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/GGXXLL/crypt/backend"
+	"github.com/hashicorp/consul/api"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -26,6 +34,156 @@ func TestClient(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []byte("test"), val)
 
+	list, err := client.List(context.TODO(), "crypt_test")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "crypt_test", list[0].Key)
+	assert.Equal(t, []byte("test"), list[0].Value)
+
+	_, version, err := client.GetWithVersion(context.TODO(), "crypt_test")
+	assert.NoError(t, err)
+	err = client.CompareAndSet(context.TODO(), "crypt_test", []byte("test"), version)
+	assert.NoError(t, err)
+	err = client.CompareAndSet(context.TODO(), "crypt_test", []byte("test"), version)
+	assert.Equal(t, backend.ErrVersionMismatch, err)
+
+	err = client.Delete(context.TODO(), "crypt_test")
+	assert.NoError(t, err)
+	_, err = client.Get(context.TODO(), "crypt_test")
+	assert.Error(t, err)
+
+	err = client.Set(context.TODO(), "crypt_test", []byte("test"))
+	assert.NoError(t, err)
+
+	prefixCtx, prefixCancel := context.WithCancel(context.Background())
+	defer prefixCancel()
+	events := client.WatchPrefix(prefixCtx, "crypt_prefix/")
+
+	err = client.Set(context.TODO(), "crypt_prefix/a", []byte("a"))
+	assert.NoError(t, err)
+	e := <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventPut, e.Type)
+	assert.Equal(t, "crypt_prefix/a", e.Key)
+	assert.Equal(t, []byte("a"), e.Value)
+
+	err = client.Delete(context.TODO(), "crypt_prefix/a")
+	assert.NoError(t, err)
+	e = <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventDelete, e.Type)
+	assert.Equal(t, "crypt_prefix/a", e.Key)
+
+	prefixCancel()
+	e = <-events
+	assert.Error(t, e.Error)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := client.Watch(ctx, "crypt_test")
+
+	err = client.Set(context.TODO(), "crypt_test", []byte("update"))
+	assert.NoError(t, err)
+
+	var r *backend.Response
+	r = <-resp
+	assert.NoError(t, r.Error)
+	assert.Equal(t, []byte("update"), r.Value)
+
+	cancel()
+	r = <-resp
+	assert.Error(t, r.Error)
+}
+
+// fakeKV is a minimal in-memory stand-in of the consul KV HTTP API which
+// supports blocking queries on single keys.
+type fakeKV struct {
+	mu      sync.Mutex
+	index   uint64
+	pairs   map[string]*api.KVPair
+	changed chan struct{}
+
+	// failures is the number of upcoming reads answered with an error
+	// once they stop blocking.
+	failures int32
+}
+
+func newFakeKV() *fakeKV {
+	return &fakeKV{index: 1, pairs: map[string]*api.KVPair{}, changed: make(chan struct{})}
+}
+
+func (f *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	switch r.Method {
+	case http.MethodGet:
+		f.get(w, r, key)
+	case http.MethodPut:
+		value, _ := ioutil.ReadAll(r.Body)
+		f.update(func() {
+			f.pairs[key] = &api.KVPair{Key: key, Value: value, ModifyIndex: f.index}
+		})
+		w.Write([]byte("true"))
+	case http.MethodDelete:
+		f.update(func() {
+			delete(f.pairs, key)
+		})
+		w.Write([]byte("true"))
+	}
+}
+
+func (f *fakeKV) update(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.index++
+	fn()
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeKV) get(w http.ResponseWriter, r *http.Request, key string) {
+	waitIndex, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	f.mu.Lock()
+	for waitIndex > 0 && f.index <= waitIndex {
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		f.mu.Lock()
+	}
+	kv, index := f.pairs[key], f.index
+	f.mu.Unlock()
+
+	if atomic.AddInt32(&f.failures, -1) >= 0 {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	if kv == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode([]*api.KVPair{kv})
+}
+
+func TestWatchBlockingQuery(t *testing.T) {
+	kv := newFakeKV()
+	srv := httptest.NewServer(kv)
+	defer srv.Close()
+
+	// a long interval makes sure changes are delivered by the blocking
+	// queries instead of by polling.
+	client, err := New([]string{srv.URL}, WithWatchInterval(time.Minute))
+	assert.NoError(t, err)
+	client.minBackoff = 10 * time.Millisecond
+	client.maxBackoff = 50 * time.Millisecond
+
+	err = client.Set(context.TODO(), "crypt_test", []byte("test"))
+	assert.NoError(t, err)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	resp := client.Watch(ctx, "crypt_test")
@@ -38,7 +196,91 @@ func TestClient(t *testing.T) {
 	assert.NoError(t, r.Error)
 	assert.Equal(t, []byte("update"), r.Value)
 
+	err = client.Delete(context.TODO(), "crypt_test")
+	assert.NoError(t, err)
+	r = <-resp
+	assert.Error(t, r.Error)
+
+	// the next two reads fail and have to be retried.
+	atomic.StoreInt32(&kv.failures, 2)
+	err = client.Set(context.TODO(), "crypt_test", []byte("recovered"))
+	assert.NoError(t, err)
+	r = <-resp
+	assert.Error(t, r.Error)
+	r = <-resp
+	assert.Error(t, r.Error)
+	r = <-resp
+	assert.NoError(t, r.Error)
+	assert.Equal(t, []byte("recovered"), r.Value)
+
 	cancel()
 	r = <-resp
 	assert.Error(t, r.Error)
 }
+
+func TestFailover(t *testing.T) {
+	var token, datacenter, namespace string
+	kv := newFakeKV()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("X-Consul-Token")
+		datacenter = r.URL.Query().Get("dc")
+		namespace = r.URL.Query().Get("ns")
+		kv.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	down := httptest.NewServer(kv)
+	down.Close()
+
+	client, err := New([]string{down.URL, srv.URL}, WithToken("secret"), WithDatacenter("dc2"), WithNamespace("team"))
+	assert.NoError(t, err)
+
+	err = client.Set(context.TODO(), "crypt_test", []byte("test"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), client.current)
+	assert.Equal(t, "secret", token)
+	assert.Equal(t, "dc2", datacenter)
+	assert.Equal(t, "team", namespace)
+
+	val, err := client.Get(context.TODO(), "crypt_test")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+
+	// errors answered by the agent don't fail over.
+	atomic.StoreInt32(&kv.failures, 1)
+	_, err = client.Get(context.TODO(), "crypt_test")
+	assert.Error(t, err)
+	assert.Equal(t, uint32(1), client.current)
+}
+
+func TestSetWithTTL(t *testing.T) {
+	addr := os.Getenv("CONSUL_ADDR")
+	if addr == "" {
+		t.Skip()
+	}
+	client, err := New(strings.Split(addr, ","), WithWatchInterval(1*time.Second))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := client.WatchPrefix(ctx, "crypt_ttl/")
+
+	err = client.SetWithTTL(context.TODO(), "crypt_ttl/a", []byte("a"), 10*time.Second)
+	assert.NoError(t, err)
+	e := <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventPut, e.Type)
+
+	// the expiry is reported like a removal.
+	e = <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventDelete, e.Type)
+	assert.Equal(t, "crypt_ttl/a", e.Key)
+	_, err = client.Get(context.TODO(), "crypt_ttl/a")
+	assert.Error(t, err)
+}
+
+func TestNextWaitIndex(t *testing.T) {
+	assert.Equal(t, uint64(12), nextWaitIndex(10, 12))
+	assert.Equal(t, uint64(1), nextWaitIndex(10, 5))
+	assert.Equal(t, uint64(1), nextWaitIndex(0, 0))
+}
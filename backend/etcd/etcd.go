@@ -2,26 +2,88 @@ package etcd
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/GGXXLL/crypt/backend"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	goetcd "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/namespace"
 )
 
+// revokeTimeout limits revoking a lease whose context is done.
+const revokeTimeout = 5 * time.Second
+
 type Client struct {
-	client *goetcd.Client
+	client    *goetcd.Client
+	config    goetcd.Config
+	namespace string
+}
+
+type OptionFunc func(client *Client)
+
+// WithTLS connects to etcd over TLS, with a client certificate for mutual
+// TLS if tlsConfig has one.
+func WithTLS(tlsConfig *tls.Config) OptionFunc {
+	return func(client *Client) {
+		client.config.TLS = tlsConfig
+	}
+}
+
+// WithAuth authenticates with the user and password of etcd's RBAC.
+func WithAuth(username, password string) OptionFunc {
+	return func(client *Client) {
+		client.config.Username = username
+		client.config.Password = password
+	}
+}
+
+// WithDialTimeout sets the timeout for establishing a connection, 5s by
+// default.
+func WithDialTimeout(timeout time.Duration) OptionFunc {
+	return func(client *Client) {
+		client.config.DialTimeout = timeout
+	}
+}
+
+// WithKeepAlive pings the server every interval and closes the connection
+// if the ping is not answered within timeout.
+func WithKeepAlive(interval, timeout time.Duration) OptionFunc {
+	return func(client *Client) {
+		client.config.DialKeepAliveTime = interval
+		client.config.DialKeepAliveTimeout = timeout
+	}
 }
 
-func New(machines []string) (*Client, error) {
-	newClient, err := goetcd.New(goetcd.Config{
-		Endpoints:   machines,
-		DialTimeout: 5 * time.Second,
-	})
+// WithNamespace prefixes every key with namespace, so the keys of several
+// applications can be kept apart in one cluster. Listed and watched keys
+// are reported without it.
+func WithNamespace(namespace string) OptionFunc {
+	return func(client *Client) {
+		client.namespace = namespace
+	}
+}
+
+func New(machines []string, opts ...OptionFunc) (*Client, error) {
+	cli := &Client{config: goetcd.Config{DialTimeout: 5 * time.Second}}
+	for _, opt := range opts {
+		opt(cli)
+	}
+	cli.config.Endpoints = machines
+	newClient, err := goetcd.New(cli.config)
 	if err != nil {
 		return nil, fmt.Errorf("creating new etcd client for crypt.backend.Client: %v", err)
 	}
-	return &Client{client: newClient}, nil
+	if cli.namespace != "" {
+		newClient.KV = namespace.NewKV(newClient.KV, cli.namespace)
+		newClient.Watcher = namespace.NewWatcher(newClient.Watcher, cli.namespace)
+		newClient.Lease = namespace.NewLease(newClient.Lease, cli.namespace)
+	}
+	cli.client = newClient
+	return cli, nil
 }
 
 func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
@@ -30,7 +92,7 @@ func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
 		return nil, err
 	}
 	if resp.Count == 0 {
-		return nil, fmt.Errorf("no such config key: %s", key)
+		return nil, backend.NotFound(key)
 	}
 
 	return resp.Kvs[0].Value, nil
@@ -41,6 +103,164 @@ func (c *Client) Set(ctx context.Context, key string, value []byte) error {
 	return err
 }
 
+// SetWithTTL attaches key to a new lease of ttl, rounded up to whole
+// seconds. etcd removes the key when the lease expires; setting the key
+// again without a TTL detaches it from the lease.
+func (c *Client) SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	lease, err := c.client.Grant(ctx, ttlSeconds(ttl))
+	if err != nil {
+		return err
+	}
+	_, err = c.client.Put(ctx, key, string(value), goetcd.WithLease(lease.ID))
+	return err
+}
+
+// Lease grants an etcd lease of ttl, rounded up to whole seconds, and keeps
+// it alive until ctx is done. The lease is revoked then, which removes all
+// keys attached to it. If the client dies without revoking it, the lease
+// and its keys expire after ttl.
+func (c *Client) Lease(ctx context.Context, ttl time.Duration) (backend.Lease, error) {
+	grant, err := c.client.Grant(ctx, ttlSeconds(ttl))
+	if err != nil {
+		return nil, err
+	}
+	keepAlive, err := c.client.KeepAlive(ctx, grant.ID)
+	if err != nil {
+		c.client.Revoke(context.Background(), grant.ID)
+		return nil, err
+	}
+	l := &lease{client: c.client, id: grant.ID, done: make(chan struct{})}
+	go func() {
+		defer close(l.done)
+		// the channel is closed when ctx is done or the lease was lost.
+		for range keepAlive {
+		}
+		if ctx.Err() != nil {
+			revokeCtx, cancel := context.WithTimeout(context.Background(), revokeTimeout)
+			defer cancel()
+			l.Revoke(revokeCtx)
+		}
+	}()
+	return l, nil
+}
+
+// ttlSeconds returns ttl rounded up to whole seconds, at least one.
+func ttlSeconds(ttl time.Duration) int64 {
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+type lease struct {
+	client *goetcd.Client
+	id     goetcd.LeaseID
+	done   chan struct{}
+}
+
+func (l *lease) Set(ctx context.Context, key string, value []byte) error {
+	_, err := l.client.Put(ctx, key, string(value), goetcd.WithLease(l.id))
+	return err
+}
+
+// Revoke revokes the lease. Revoking an expired lease is not an error.
+func (l *lease) Revoke(ctx context.Context) error {
+	_, err := l.client.Revoke(ctx, l.id)
+	if err == rpctypes.ErrLeaseNotFound {
+		return nil
+	}
+	return err
+}
+
+func (l *lease) Done() <-chan struct{} {
+	return l.done
+}
+
+// GetWithVersion returns the value of key together with its ModRevision.
+func (c *Client) GetWithVersion(ctx context.Context, key string) ([]byte, backend.Version, error) {
+	resp, err := c.client.Get(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.Count == 0 {
+		return nil, "", backend.NotFound(key)
+	}
+	kv := resp.Kvs[0]
+	return kv.Value, backend.Version(strconv.FormatInt(kv.ModRevision, 10)), nil
+}
+
+// CompareAndSet puts value in a transaction guarded by the ModRevision of
+// key.
+func (c *Client) CompareAndSet(ctx context.Context, key string, value []byte, expected backend.Version) error {
+	var rev int64
+	if expected != "" {
+		var err error
+		rev, err = strconv.ParseInt(string(expected), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid etcd version %q: %v", expected, err)
+		}
+	}
+	resp, err := c.client.Txn(ctx).
+		If(goetcd.Compare(goetcd.ModRevision(key), "=", rev)).
+		Then(goetcd.OpPut(key, string(value))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return backend.ErrVersionMismatch
+	}
+	return nil
+}
+
+// History walks back the revisions of key until limit values are found,
+// the key did not exist or the revision has been compacted.
+func (c *Client) History(ctx context.Context, key string, limit int) ([]*backend.Revision, error) {
+	resp, err := c.client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Count == 0 {
+		return nil, backend.NotFound(key)
+	}
+	history := make([]*backend.Revision, 0, limit)
+	rev := resp.Kvs[0].ModRevision
+	for len(history) < limit && rev > 1 {
+		resp, err := c.client.Get(ctx, key, goetcd.WithRev(rev-1))
+		if err == rpctypes.ErrCompacted {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if resp.Count == 0 {
+			break
+		}
+		kv := resp.Kvs[0]
+		history = append(history, &backend.Revision{Index: kv.ModRevision, Value: kv.Value})
+		rev = kv.ModRevision
+	}
+	return history, nil
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.client.Delete(ctx, key)
+	return err
+}
+
+func (c *Client) List(ctx context.Context, prefix string) (backend.KVPairs, error) {
+	resp, err := c.client.Get(ctx, prefix, goetcd.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	list := make(backend.KVPairs, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		list = append(list, &backend.KVPair{Key: string(kv.Key), Value: kv.Value})
+	}
+	return list, nil
+}
+
 func (c *Client) Watch(ctx context.Context, key string) <-chan *backend.Response {
 	respChan := make(chan *backend.Response, 0)
 	go func() {
@@ -67,3 +287,40 @@ func (c *Client) Watch(ctx context.Context, key string) <-chan *backend.Response
 	}()
 	return respChan
 }
+
+func (c *Client) WatchPrefix(ctx context.Context, prefix string) <-chan *backend.Event {
+	eventChan := make(chan *backend.Event, 0)
+	rch := c.client.Watch(ctx, prefix, goetcd.WithPrefix())
+	go func() {
+		defer close(eventChan)
+		for {
+			select {
+			case resp, ok := <-rch:
+				if !ok {
+					err := ctx.Err()
+					if err == nil {
+						err = errors.New("etcd watch channel closed")
+					}
+					eventChan <- &backend.Event{Error: err}
+					return
+				}
+				if resp.Err() != nil {
+					eventChan <- &backend.Event{Error: resp.Err()}
+					continue
+				}
+				for _, e := range resp.Events {
+					event := &backend.Event{Type: backend.EventPut, Key: string(e.Kv.Key), Value: e.Kv.Value}
+					if e.Type == goetcd.EventTypeDelete {
+						event.Type = backend.EventDelete
+						event.Value = nil
+					}
+					eventChan <- event
+				}
+			case <-ctx.Done():
+				eventChan <- &backend.Event{Error: ctx.Err()}
+				return
+			}
+		}
+	}()
+	return eventChan
+}
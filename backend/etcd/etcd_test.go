@@ -5,6 +5,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/GGXXLL/crypt/backend"
 	"github.com/stretchr/testify/assert"
@@ -25,6 +26,55 @@ func TestClient(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []byte("test"), val)
 
+	list, err := client.List(context.TODO(), "crypt_test")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "crypt_test", list[0].Key)
+	assert.Equal(t, []byte("test"), list[0].Value)
+
+	_, version, err := client.GetWithVersion(context.TODO(), "crypt_test")
+	assert.NoError(t, err)
+	err = client.CompareAndSet(context.TODO(), "crypt_test", []byte("test"), version)
+	assert.NoError(t, err)
+	err = client.CompareAndSet(context.TODO(), "crypt_test", []byte("test"), version)
+	assert.Equal(t, backend.ErrVersionMismatch, err)
+
+	history, err := client.History(context.TODO(), "crypt_test", 1)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, []byte("test"), history[0].Value)
+
+	err = client.Delete(context.TODO(), "crypt_test")
+	assert.NoError(t, err)
+	_, err = client.Get(context.TODO(), "crypt_test")
+	assert.Error(t, err)
+
+	err = client.Set(context.TODO(), "crypt_test", []byte("test"))
+	assert.NoError(t, err)
+
+	prefixCtx, prefixCancel := context.WithCancel(context.Background())
+	defer prefixCancel()
+	events := client.WatchPrefix(prefixCtx, "crypt_prefix/")
+
+	err = client.Set(context.TODO(), "crypt_prefix/a", []byte("a"))
+	assert.NoError(t, err)
+	e := <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventPut, e.Type)
+	assert.Equal(t, "crypt_prefix/a", e.Key)
+	assert.Equal(t, []byte("a"), e.Value)
+
+	err = client.Delete(context.TODO(), "crypt_prefix/a")
+	assert.NoError(t, err)
+	e = <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventDelete, e.Type)
+	assert.Equal(t, "crypt_prefix/a", e.Key)
+
+	prefixCancel()
+	e = <-events
+	assert.Error(t, e.Error)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -41,3 +91,83 @@ func TestClient(t *testing.T) {
 	r = <-resp
 	assert.Error(t, r.Error)
 }
+
+func TestNamespace(t *testing.T) {
+	addr := os.Getenv("ETCD_ADDR")
+	if addr == "" {
+		t.Skip()
+	}
+	client, err := New(strings.Split(addr, ","), WithNamespace("crypt_ns/"), WithDialTimeout(time.Second))
+	assert.NoError(t, err)
+	plain, err := New(strings.Split(addr, ","))
+	assert.NoError(t, err)
+
+	err = client.Set(context.TODO(), "test", []byte("test"))
+	assert.NoError(t, err)
+
+	val, err := plain.Get(context.TODO(), "crypt_ns/test")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+
+	list, err := client.List(context.TODO(), "te")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "test", list[0].Key)
+
+	err = client.Delete(context.TODO(), "test")
+	assert.NoError(t, err)
+	_, err = plain.Get(context.TODO(), "crypt_ns/test")
+	assert.Error(t, err)
+}
+
+func TestSetWithTTL(t *testing.T) {
+	addr := os.Getenv("ETCD_ADDR")
+	if addr == "" {
+		t.Skip()
+	}
+	client, err := New(strings.Split(addr, ","))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := client.WatchPrefix(ctx, "crypt_ttl/")
+
+	err = client.SetWithTTL(context.TODO(), "crypt_ttl/a", []byte("a"), 1*time.Second)
+	assert.NoError(t, err)
+	e := <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventPut, e.Type)
+
+	// the expiry is reported like a removal.
+	e = <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventDelete, e.Type)
+	assert.Equal(t, "crypt_ttl/a", e.Key)
+	_, err = client.Get(context.TODO(), "crypt_ttl/a")
+	assert.Error(t, err)
+}
+
+func TestLease(t *testing.T) {
+	addr := os.Getenv("ETCD_ADDR")
+	if addr == "" {
+		t.Skip()
+	}
+	client, err := New(strings.Split(addr, ","))
+	assert.NoError(t, err)
+
+	// keepalives outlive the TTL of the lease.
+	ctx, cancel := context.WithCancel(context.Background())
+	lease, err := client.Lease(ctx, 1*time.Second)
+	assert.NoError(t, err)
+	err = lease.Set(context.TODO(), "crypt_lease", []byte("canary"))
+	assert.NoError(t, err)
+	time.Sleep(3 * time.Second)
+	val, err := client.Get(context.TODO(), "crypt_lease")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("canary"), val)
+
+	cancel()
+	<-lease.Done()
+	_, err = client.Get(context.TODO(), "crypt_lease")
+	assert.Error(t, err)
+}
@@ -0,0 +1,270 @@
+package file
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GGXXLL/crypt/backend"
+	"github.com/GGXXLL/crypt/internal"
+)
+
+// tempPrefix names the temporary files values are written to before they
+// are renamed into place.
+const tempPrefix = ".crypt-tmp-"
+
+// Client stores every key in a file below a root directory. Nested keys
+// like "app/config" map to nested directories.
+type Client struct {
+	root          string
+	lock          sync.Mutex
+	watchInterval time.Duration
+}
+
+type OptionFunc func(client *Client)
+
+func WithWatchInterval(duration time.Duration) OptionFunc {
+	return func(client *Client) {
+		client.watchInterval = duration
+	}
+}
+
+// New creates a client storing keys below the directory machines[0], which
+// is created if it does not exist.
+func New(machines []string, opts ...OptionFunc) (*Client, error) {
+	if len(machines) == 0 {
+		return nil, errors.New("root directory should be defined")
+	}
+	root, err := filepath.Abs(machines[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("creating root directory for crypt.backend.Client: %v", err)
+	}
+	cli := &Client{root: root, watchInterval: 10 * time.Second}
+	for _, opt := range opts {
+		opt(cli)
+	}
+	return cli, nil
+}
+
+// path returns the file of key and makes sure it stays below the root.
+func (c *Client) path(key string) (string, error) {
+	p := filepath.Join(c.root, filepath.FromSlash(strings.TrimPrefix(key, "/")))
+	if p == c.root || !strings.HasPrefix(p, c.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid key: %s", key)
+	}
+	return p, nil
+}
+
+func (c *Client) Get(_ context.Context, key string) ([]byte, error) {
+	p, err := c.path(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, backend.NotFound(key)
+	}
+	return value, err
+}
+
+func (c *Client) Set(_ context.Context, key string, value []byte) error {
+	p, err := c.path(key)
+	if err != nil {
+		return err
+	}
+	return write(p, value)
+}
+
+// write atomically replaces the file at p by writing value to a temporary
+// file in the same directory and renaming it.
+func write(p string, value []byte) error {
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// GetWithVersion returns the value of key together with a hash of it.
+func (c *Client) GetWithVersion(ctx context.Context, key string) ([]byte, backend.Version, error) {
+	value, err := c.Get(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	return value, version(value), nil
+}
+
+// CompareAndSet sets key only if its value still hashes to expected. The
+// check is only atomic for writers sharing this Client.
+func (c *Client) CompareAndSet(ctx context.Context, key string, value []byte, expected backend.Version) error {
+	p, err := c.path(key)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var current backend.Version
+	old, err := ioutil.ReadFile(p)
+	switch {
+	case err == nil:
+		current = version(old)
+	case !os.IsNotExist(err):
+		return err
+	}
+	if current != expected {
+		return backend.ErrVersionMismatch
+	}
+	return write(p, value)
+}
+
+func version(value []byte) backend.Version {
+	return backend.Version(hex.EncodeToString(internal.GenMD5(value)))
+}
+
+func (c *Client) Delete(_ context.Context, key string) error {
+	p, err := c.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List walks the directory containing prefix and returns all keys starting
+// with prefix.
+func (c *Client) List(_ context.Context, prefix string) (backend.KVPairs, error) {
+	trimmed := strings.TrimPrefix(prefix, "/")
+	dir := c.root
+	if i := strings.LastIndex(trimmed, "/"); i >= 0 {
+		dir = filepath.Join(c.root, filepath.FromSlash(trimmed[:i]))
+	}
+
+	list := backend.KVPairs{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(c.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, trimmed) {
+			return nil
+		}
+		value, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			// removed while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(prefix, "/") {
+			key = "/" + key
+		}
+		list = append(list, &backend.KVPair{Key: key, Value: value})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, nil
+}
+
+// Watch polls the file of key every watchInterval and reports changes of
+// its content. Removal of the file is reported as an error.
+func (c *Client) Watch(ctx context.Context, key string) <-chan *backend.Response {
+	respChan := make(chan *backend.Response, 0)
+	_, current, _ := c.GetWithVersion(ctx, key)
+	go func() {
+		defer close(respChan)
+		for {
+			select {
+			case <-time.After(c.watchInterval):
+				value, v, err := c.GetWithVersion(ctx, key)
+				if err != nil {
+					if current != "" {
+						current = ""
+						respChan <- &backend.Response{Error: err}
+					}
+					continue
+				}
+				if v == current {
+					continue
+				}
+				current = v
+				respChan <- &backend.Response{Value: value}
+			case <-ctx.Done():
+				respChan <- &backend.Response{Error: ctx.Err()}
+				return
+			}
+		}
+	}()
+	return respChan
+}
+
+func (c *Client) WatchPrefix(ctx context.Context, prefix string) <-chan *backend.Event {
+	eventChan := make(chan *backend.Event, 0)
+	list, err := c.List(ctx, prefix)
+	cache := internal.NewPrefixCache(list)
+	go func() {
+		defer close(eventChan)
+		if err != nil {
+			eventChan <- &backend.Event{Error: err}
+		}
+		for {
+			select {
+			case <-time.After(c.watchInterval):
+				list, err := c.List(ctx, prefix)
+				if err != nil {
+					eventChan <- &backend.Event{Error: err}
+					continue
+				}
+				internal.WatchPrefixCache(cache, list, eventChan)
+			case <-ctx.Done():
+				eventChan <- &backend.Event{Error: ctx.Err()}
+				return
+			}
+		}
+	}()
+	return eventChan
+}
@@ -0,0 +1,83 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/GGXXLL/crypt/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient(t *testing.T) {
+	client, err := New([]string{t.TempDir()}, WithWatchInterval(10*time.Millisecond))
+	assert.NoError(t, err)
+
+	err = client.Set(context.TODO(), "crypt/test", []byte("test"))
+	assert.NoError(t, err)
+
+	val, err := client.Get(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+
+	_, err = client.Get(context.TODO(), "../escape")
+	assert.Error(t, err)
+
+	list, err := client.List(context.TODO(), "/crypt/")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "/crypt/test", list[0].Key)
+	assert.Equal(t, []byte("test"), list[0].Value)
+
+	files, err := ioutil.ReadDir(client.root + "/crypt")
+	assert.NoError(t, err)
+	assert.Len(t, files, 1, "temporary files must be removed")
+
+	_, version, err := client.GetWithVersion(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("cas"), version)
+	assert.NoError(t, err)
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("cas"), version)
+	assert.Equal(t, backend.ErrVersionMismatch, err)
+
+	err = client.Delete(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+	_, err = client.Get(context.TODO(), "crypt/test")
+	assert.True(t, errors.Is(err, backend.ErrNotFound))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := client.Watch(ctx, "crypt/test")
+	events := client.WatchPrefix(ctx, "crypt/")
+
+	err = client.Set(context.TODO(), "crypt/test", []byte("update"))
+	assert.NoError(t, err)
+
+	var r *backend.Response
+	r = <-resp
+	assert.NoError(t, r.Error)
+	assert.Equal(t, []byte("update"), r.Value)
+
+	e := <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventPut, e.Type)
+	assert.Equal(t, "crypt/test", e.Key)
+	assert.Equal(t, []byte("update"), e.Value)
+
+	err = client.Delete(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+
+	r = <-resp
+	assert.Error(t, r.Error)
+	e = <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventDelete, e.Type)
+
+	cancel()
+	r = <-resp
+	assert.Error(t, r.Error)
+	e = <-events
+	assert.Error(t, e.Error)
+}
@@ -3,20 +3,29 @@ package firestore
 import (
 	"context"
 	"errors"
-	"sync"
+	"fmt"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/firestore"
 	"github.com/GGXXLL/crypt/backend"
 	"github.com/GGXXLL/crypt/internal"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	minRetryBackoff = 500 * time.Millisecond
+	maxRetryBackoff = 30 * time.Second
 )
 
 type Client struct {
-	client        *firestore.Client
-	cache         *sync.Map
-	watchInterval time.Duration
+	client     *firestore.Client
+	minBackoff time.Duration
+	maxBackoff time.Duration
 }
 
 type data struct {
@@ -25,12 +34,17 @@ type data struct {
 
 type OptionFunc func(client *Client)
 
-func WithWatchInterval(duration time.Duration) OptionFunc {
-	return func(client *Client) {
-		client.watchInterval = duration
-	}
+// WithWatchInterval is kept for compatibility and has no effect: watches
+// are driven by realtime snapshot listeners.
+//
+// Deprecated: Watch and WatchPrefix no longer poll.
+func WithWatchInterval(_ time.Duration) OptionFunc {
+	return func(client *Client) {}
 }
 
+// New creates a client for the project machines[0]. If the
+// FIRESTORE_EMULATOR_HOST environment variable is set, the client talks to
+// the Firestore emulator at that address instead.
 func New(machines []string, opts ...OptionFunc) (*Client, error) {
 	if len(machines) == 0 {
 		return nil, errors.New("project should be defined")
@@ -43,9 +57,9 @@ func New(machines []string, opts ...OptionFunc) (*Client, error) {
 		return nil, err
 	}
 	cli := &Client{
-		client:        c,
-		cache:         &sync.Map{},
-		watchInterval: 10 * time.Second,
+		client:     c,
+		minBackoff: minRetryBackoff,
+		maxBackoff: maxRetryBackoff,
 	}
 	for _, opt := range opts {
 		opt(cli)
@@ -55,13 +69,18 @@ func New(machines []string, opts ...OptionFunc) (*Client, error) {
 
 func (c *Client) Get(ctx context.Context, path string) ([]byte, error) {
 	snap, err := c.client.Doc(path).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, backend.NotFound(path)
+	}
 	if err != nil {
 		return nil, err
 	}
+	return decode(snap)
+}
 
+func decode(snap *firestore.DocumentSnapshot) ([]byte, error) {
 	d := &data{}
-	err = snap.DataTo(&d)
-	if err != nil {
+	if err := snap.DataTo(d); err != nil {
 		return nil, err
 	}
 	return d.Data, nil
@@ -72,23 +91,141 @@ func (c *Client) Set(ctx context.Context, path string, value []byte) error {
 	return err
 }
 
+// GetWithVersion returns the value of the document at path together with
+// its update time.
+func (c *Client) GetWithVersion(ctx context.Context, path string) ([]byte, backend.Version, error) {
+	snap, err := c.client.Doc(path).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, "", backend.NotFound(path)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	value, err := decode(snap)
+	if err != nil {
+		return nil, "", err
+	}
+	return value, backend.Version(snap.UpdateTime.Format(time.RFC3339Nano)), nil
+}
+
+// CompareAndSet updates the document at path with a last update time
+// precondition, or creates it if expected is empty.
+func (c *Client) CompareAndSet(ctx context.Context, path string, value []byte, expected backend.Version) error {
+	doc := c.client.Doc(path)
+	var err error
+	if expected == "" {
+		_, err = doc.Create(ctx, &data{value})
+	} else {
+		updateTime, perr := time.Parse(time.RFC3339Nano, string(expected))
+		if perr != nil {
+			return fmt.Errorf("invalid firestore version %q: %v", expected, perr)
+		}
+		_, err = doc.Update(ctx, []firestore.Update{{Path: "data", Value: value}}, firestore.LastUpdateTime(updateTime))
+	}
+	switch status.Code(err) {
+	case codes.AlreadyExists, codes.FailedPrecondition, codes.NotFound:
+		return backend.ErrVersionMismatch
+	}
+	return err
+}
+
+func (c *Client) Delete(ctx context.Context, path string) error {
+	_, err := c.client.Doc(path).Delete(ctx)
+	return err
+}
+
+// historySeparator separates a document ID from the ID of its history ring
+// documents. The default ring keys would add a path segment.
+const historySeparator = "@history-"
+
+// HistoryKey returns the path of the document holding slot of the history
+// ring of path, in the same collection.
+func (c *Client) HistoryKey(path, slot string) string {
+	return path + historySeparator + slot
+}
+
+// IsHistoryKey reports whether path is the path of a history ring document.
+func (c *Client) IsHistoryKey(path string) bool {
+	return strings.Contains(path, historySeparator)
+}
+
+// List returns all documents of the collection at path, keyed by
+// "path/documentID".
+func (c *Client) List(ctx context.Context, path string) (backend.KVPairs, error) {
+	col := c.client.Collection(path)
+	if col == nil {
+		return nil, fmt.Errorf("invalid collection path: %s", path)
+	}
+	return c.list(path, col.Documents(ctx))
+}
+
+func (c *Client) list(path string, iter *firestore.DocumentIterator) (backend.KVPairs, error) {
+	defer iter.Stop()
+
+	list := backend.KVPairs{}
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		value, err := decode(snap)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, &backend.KVPair{
+			Key:   strings.TrimSuffix(path, "/") + "/" + snap.Ref.ID,
+			Value: value,
+		})
+	}
+	return list, nil
+}
+
+// Watch listens to realtime snapshots of the document at path. Deletion of
+// the document is reported as an error. When the snapshot stream breaks it
+// is resubscribed after a backoff.
 func (c *Client) Watch(ctx context.Context, path string) <-chan *backend.Response {
 	ch := make(chan *backend.Response, 0)
 
+	// remember the current version, so only later changes are reported.
+	var updateTime time.Time
+	if snap, err := c.client.Doc(path).Get(ctx); err == nil {
+		updateTime = snap.UpdateTime
+	}
 	go func() {
-		defer func() {
-			close(ch)
-		}()
+		defer close(ch)
+		var delay time.Duration
 		for {
-			select {
-			case <-time.After(c.watchInterval):
-				val, err := c.Get(ctx, path)
+			it := c.client.Doc(path).Snapshots(ctx)
+			for {
+				snap, err := it.Next()
 				if err != nil {
-					ch <- &backend.Response{Error: err}
+					it.Stop()
+					if ctx.Err() == nil {
+						ch <- &backend.Response{Error: err}
+					}
+					break
+				}
+				delay = 0
+				if !snap.Exists() {
+					if !updateTime.IsZero() {
+						updateTime = time.Time{}
+						ch <- &backend.Response{Error: status.Errorf(codes.NotFound, "document %s was deleted", path)}
+					}
+					continue
+				}
+				if snap.UpdateTime.Equal(updateTime) {
 					continue
 				}
-				internal.WatchCache(c.cache, path, val, ch)
-			case <-ctx.Done():
+				updateTime = snap.UpdateTime
+				value, err := decode(snap)
+				ch <- &backend.Response{Value: value, Error: err}
+			}
+
+			delay = internal.Backoff(delay, c.minBackoff, c.maxBackoff)
+			if !internal.Sleep(ctx, delay) {
 				ch <- &backend.Response{Error: ctx.Err()}
 				return
 			}
@@ -96,3 +233,48 @@ func (c *Client) Watch(ctx context.Context, path string) <-chan *backend.Respons
 	}()
 	return ch
 }
+
+// WatchPrefix listens to realtime snapshots of the collection at path and
+// reports changed documents. When the snapshot stream breaks it is
+// resubscribed after a backoff.
+func (c *Client) WatchPrefix(ctx context.Context, path string) <-chan *backend.Event {
+	eventChan := make(chan *backend.Event, 0)
+	list, err := c.List(ctx, path)
+	cache := internal.NewPrefixCache(list)
+	go func() {
+		defer close(eventChan)
+		if err != nil {
+			eventChan <- &backend.Event{Error: err}
+		}
+		col := c.client.Collection(path)
+		if col == nil {
+			return
+		}
+		var delay time.Duration
+		for {
+			it := col.Snapshots(ctx)
+			for {
+				snap, err := it.Next()
+				if err == nil {
+					list, err = c.list(path, snap.Documents)
+				}
+				if err != nil {
+					it.Stop()
+					if ctx.Err() == nil {
+						eventChan <- &backend.Event{Error: err}
+					}
+					break
+				}
+				delay = 0
+				internal.WatchPrefixCache(cache, list, eventChan)
+			}
+
+			delay = internal.Backoff(delay, c.minBackoff, c.maxBackoff)
+			if !internal.Sleep(ctx, delay) {
+				eventChan <- &backend.Event{Error: ctx.Err()}
+				return
+			}
+		}
+	}()
+	return eventChan
+}
@@ -0,0 +1,82 @@
+package firestore
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/GGXXLL/crypt/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip()
+	}
+	client, err := New([]string{"crypt-test"})
+	assert.NoError(t, err)
+
+	err = client.Set(context.TODO(), "crypt/test", []byte("test"))
+	assert.NoError(t, err)
+
+	val, err := client.Get(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+
+	_, version, err := client.GetWithVersion(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("test"), version)
+	assert.NoError(t, err)
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("test"), version)
+	assert.Equal(t, backend.ErrVersionMismatch, err)
+
+	list, err := client.List(context.TODO(), "crypt")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "crypt/test", list[0].Key)
+	assert.Equal(t, []byte("test"), list[0].Value)
+
+	prefixCtx, prefixCancel := context.WithCancel(context.Background())
+	defer prefixCancel()
+	events := client.WatchPrefix(prefixCtx, "crypt_prefix")
+
+	err = client.Set(context.TODO(), "crypt_prefix/a", []byte("a"))
+	assert.NoError(t, err)
+	e := <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventPut, e.Type)
+	assert.Equal(t, "crypt_prefix/a", e.Key)
+	assert.Equal(t, []byte("a"), e.Value)
+
+	err = client.Delete(context.TODO(), "crypt_prefix/a")
+	assert.NoError(t, err)
+	e = <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventDelete, e.Type)
+	assert.Equal(t, "crypt_prefix/a", e.Key)
+
+	prefixCancel()
+	e = <-events
+	assert.Error(t, e.Error)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := client.Watch(ctx, "crypt/test")
+
+	err = client.Set(context.TODO(), "crypt/test", []byte("update"))
+	assert.NoError(t, err)
+
+	var r *backend.Response
+	r = <-resp
+	assert.NoError(t, r.Error)
+	assert.Equal(t, []byte("update"), r.Value)
+
+	err = client.Delete(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+	r = <-resp
+	assert.Error(t, r.Error)
+
+	cancel()
+	r = <-resp
+	assert.Error(t, r.Error)
+}
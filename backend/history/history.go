@@ -0,0 +1,310 @@
+// Package history keeps the previous values of keys of a backend.Store.
+//
+// Stores that implement backend.HistoryStore, like etcd, are used as they
+// are. For all other stores the previous values are kept by crypt in a ring
+// of keys next to the original one:
+//
+//	key@history/head   number of the latest recorded revision
+//	key@history/N      previous value of revision N
+//
+// Revisions older than the depth are removed when a new one is recorded, so
+// changing the depth never maps a revision to another value.
+//
+// Keys of the ring are hidden from List and WatchPrefix. Stores whose keys
+// can't hold these ring keys choose their own by implementing
+// backend.HistoryKeyStore.
+package history
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GGXXLL/crypt/backend"
+)
+
+// Separator separates a key from the keys of its history ring.
+const Separator = "@history/"
+
+// DefaultDepth is the number of previous values kept by default.
+const DefaultDepth = 10
+
+// maxReserveAttempts bounds the retries of concurrent writers competing for
+// the next revision of a key.
+const maxReserveAttempts = 10
+
+// Store wraps a backend.Store and records the previous value of a key every
+// time the key is changed through it.
+type Store struct {
+	backend.Store
+	native backend.HistoryStore
+	keys   backend.HistoryKeyStore
+	depth  int
+}
+
+type OptionFunc func(s *Store)
+
+// WithDepth sets the number of previous values kept for each key. A depth
+// of zero disables recording.
+func WithDepth(depth int) OptionFunc {
+	return func(s *Store) {
+		s.depth = depth
+	}
+}
+
+func New(store backend.Store, opts ...OptionFunc) *Store {
+	s := &Store{Store: store, depth: DefaultDepth}
+	if native, ok := store.(backend.HistoryStore); ok {
+		s.native = native
+	}
+	if keys, ok := store.(backend.HistoryKeyStore); ok {
+		s.keys = keys
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// IsHistoryKey reports whether key belongs to the history ring of a key.
+func IsHistoryKey(key string) bool {
+	return strings.Contains(key, Separator)
+}
+
+func (s *Store) headKey(key string) string {
+	return s.ringKey(key, "head")
+}
+
+func (s *Store) slotKey(key string, n int64) string {
+	return s.ringKey(key, strconv.FormatInt(n, 10))
+}
+
+func (s *Store) ringKey(key, slot string) string {
+	if s.keys != nil {
+		return s.keys.HistoryKey(key, slot)
+	}
+	return key + Separator + slot
+}
+
+func (s *Store) isHistoryKey(key string) bool {
+	if s.keys != nil {
+		return s.keys.IsHistoryKey(key)
+	}
+	return IsHistoryKey(key)
+}
+
+func (s *Store) Set(ctx context.Context, key string, value []byte) error {
+	if err := s.record(ctx, key); err != nil {
+		return err
+	}
+	return s.Store.Set(ctx, key, value)
+}
+
+// SetWithTTL records the previous value of key and sets it with a TTL if
+// the wrapped store supports TTLs, backend.ErrTTLNotSupported is returned
+// otherwise. The expiry itself is not recorded.
+func (s *Store) SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	store, ok := s.Store.(backend.TTLStore)
+	if !ok {
+		return backend.ErrTTLNotSupported
+	}
+	if err := s.record(ctx, key); err != nil {
+		return err
+	}
+	return store.SetWithTTL(ctx, key, value, ttl)
+}
+
+// CompareAndSet records the previous value of key once the value has been
+// set, so a failed change leaves no revision behind.
+func (s *Store) CompareAndSet(ctx context.Context, key string, value []byte, expected backend.Version) error {
+	if !s.recording() || s.headKey(key) == "" {
+		return s.Store.CompareAndSet(ctx, key, value, expected)
+	}
+	prev, version, err := s.Store.GetWithVersion(ctx, key)
+	if err != nil && !errors.Is(err, backend.ErrNotFound) {
+		return err
+	}
+	if version != expected {
+		return backend.ErrVersionMismatch
+	}
+	if err := s.Store.CompareAndSet(ctx, key, value, expected); err != nil {
+		return err
+	}
+	if version == "" {
+		return nil
+	}
+	return s.save(ctx, key, prev)
+}
+
+func (s *Store) Delete(ctx context.Context, key string) error {
+	if err := s.record(ctx, key); err != nil {
+		return err
+	}
+	return s.Store.Delete(ctx, key)
+}
+
+func (s *Store) List(ctx context.Context, prefix string) (backend.KVPairs, error) {
+	list, err := s.Store.List(ctx, prefix)
+	if err != nil || !s.recording() {
+		return list, err
+	}
+	filtered := make(backend.KVPairs, 0, len(list))
+	for _, kv := range list {
+		if !s.isHistoryKey(kv.Key) {
+			filtered = append(filtered, kv)
+		}
+	}
+	return filtered, nil
+}
+
+func (s *Store) WatchPrefix(ctx context.Context, prefix string) <-chan *backend.Event {
+	events := s.Store.WatchPrefix(ctx, prefix)
+	if !s.recording() {
+		return events
+	}
+	eventChan := make(chan *backend.Event, 0)
+	go func() {
+		defer close(eventChan)
+		for e := range events {
+			if e.Error == nil && s.isHistoryKey(e.Key) {
+				continue
+			}
+			eventChan <- e
+		}
+	}()
+	return eventChan
+}
+
+// History returns up to limit previous values of key, newest first.
+func (s *Store) History(ctx context.Context, key string, limit int) ([]*backend.Revision, error) {
+	if s.native != nil {
+		return s.native.History(ctx, key, limit)
+	}
+	if s.headKey(key) == "" {
+		return nil, fmt.Errorf("the backend keeps no history of key %s", key)
+	}
+	head, _, err := s.head(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]*backend.Revision, 0)
+	for n := head; n > 0 && n > head-int64(s.depth) && len(history) < limit; n-- {
+		value, err := s.Store.Get(ctx, s.slotKey(key, n))
+		if errors.Is(err, backend.ErrNotFound) {
+			// reserved by a writer which has not stored it yet
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, &backend.Revision{Index: n, Value: value})
+	}
+	return history, nil
+}
+
+// Rollback sets key back to the value of its revision index. The value
+// being replaced is recorded like on every other change.
+func (s *Store) Rollback(ctx context.Context, key string, index int64) error {
+	history, err := s.History(ctx, key, s.depth)
+	if err != nil {
+		return err
+	}
+	for _, rev := range history {
+		if rev.Index == index {
+			return s.Set(ctx, key, rev.Value)
+		}
+	}
+	return fmt.Errorf("revision %d of key %s not found", index, key)
+}
+
+func (s *Store) recording() bool {
+	return s.native == nil && s.depth > 0
+}
+
+// record copies the current value of key into the next slot of its
+// history ring. Keys which don't exist yet have nothing to record.
+func (s *Store) record(ctx context.Context, key string) error {
+	if !s.recording() || s.headKey(key) == "" {
+		return nil
+	}
+	prev, err := s.Store.Get(ctx, key)
+	if errors.Is(err, backend.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.save(ctx, key, prev)
+}
+
+// save stores prev as the next revision of key and removes the revisions
+// which are older than the depth.
+func (s *Store) save(ctx context.Context, key string, prev []byte) error {
+	n, err := s.reserve(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := s.Store.Set(ctx, s.slotKey(key, n), prev); err != nil {
+		return err
+	}
+	return s.prune(ctx, key, n-int64(s.depth))
+}
+
+// prune removes revision n of key and the ones before it, which are left
+// over from a larger depth, down to the first one already removed.
+func (s *Store) prune(ctx context.Context, key string, n int64) error {
+	for ; n > 0; n-- {
+		_, err := s.Store.Get(ctx, s.slotKey(key, n))
+		if errors.Is(err, backend.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.Store.Delete(ctx, s.slotKey(key, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reserve bumps the head of the history ring of key and returns the number
+// of the revision the caller may write.
+func (s *Store) reserve(ctx context.Context, key string) (int64, error) {
+	for i := 0; i < maxReserveAttempts; i++ {
+		head, version, err := s.head(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		n := head + 1
+		err = s.Store.CompareAndSet(ctx, s.headKey(key), []byte(strconv.FormatInt(n, 10)), version)
+		if errors.Is(err, backend.ErrVersionMismatch) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+	return 0, errors.New("too many concurrent changes to the history of " + key)
+}
+
+// head returns the latest revision recorded for key, zero if there is none.
+func (s *Store) head(ctx context.Context, key string) (int64, backend.Version, error) {
+	value, version, err := s.Store.GetWithVersion(ctx, s.headKey(key))
+	if errors.Is(err, backend.ErrNotFound) {
+		// the ring has not been created yet
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid history head of key %s: %v", key, err)
+	}
+	return n, version, nil
+}
@@ -0,0 +1,192 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/GGXXLL/crypt/backend"
+	"github.com/GGXXLL/crypt/backend/mock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistory(t *testing.T) {
+	store, err := mock.New([]string{})
+	assert.NoError(t, err)
+
+	s := New(store, WithDepth(2))
+	for _, v := range []string{"v1", "v2", "v3", "v4"} {
+		err = s.Set(context.TODO(), "crypt_history", []byte(v))
+		assert.NoError(t, err)
+	}
+
+	history, err := s.History(context.TODO(), "crypt_history", 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, int64(3), history[0].Index)
+	assert.Equal(t, []byte("v3"), history[0].Value)
+	assert.Equal(t, int64(2), history[1].Index)
+	assert.Equal(t, []byte("v2"), history[1].Value)
+
+	list, err := s.List(context.TODO(), "crypt_history")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "crypt_history", list[0].Key)
+
+	err = s.Rollback(context.TODO(), "crypt_history", 2)
+	assert.NoError(t, err)
+	val, err := s.Get(context.TODO(), "crypt_history")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), val)
+
+	history, err = s.History(context.TODO(), "crypt_history", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), history[0].Index)
+	assert.Equal(t, []byte("v4"), history[0].Value)
+
+	err = s.Rollback(context.TODO(), "crypt_history", 1)
+	assert.Error(t, err)
+}
+
+// failingStore fails every read, like a backend which can't be reached.
+type failingStore struct {
+	backend.Store
+}
+
+func (failingStore) Get(context.Context, string) ([]byte, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (failingStore) GetWithVersion(context.Context, string) ([]byte, backend.Version, error) {
+	return nil, "", errors.New("connection refused")
+}
+
+func TestRecordErrors(t *testing.T) {
+	store, err := mock.New([]string{})
+	assert.NoError(t, err)
+
+	// keys which don't exist yet have nothing to record.
+	s := New(store)
+	err = s.Set(context.TODO(), "crypt_history_new", []byte("v1"))
+	assert.NoError(t, err)
+	_, err = store.Get(context.TODO(), "crypt_history_new"+Separator+"head")
+	assert.True(t, errors.Is(err, backend.ErrNotFound))
+
+	// other errors are not mistaken for missing keys.
+	s = New(failingStore{store})
+	err = s.Set(context.TODO(), "crypt_history_new", []byte("v2"))
+	assert.EqualError(t, err, "connection refused")
+	err = s.Delete(context.TODO(), "crypt_history_new")
+	assert.EqualError(t, err, "connection refused")
+}
+
+// keyStore keeps history rings under its own keys, or none if disabled.
+type keyStore struct {
+	backend.Store
+	disabled bool
+}
+
+func (s keyStore) HistoryKey(key, slot string) string {
+	if s.disabled {
+		return ""
+	}
+	return key + ".history." + slot
+}
+
+func (s keyStore) IsHistoryKey(key string) bool {
+	return strings.Contains(key, ".history.")
+}
+
+func TestHistoryKeyStore(t *testing.T) {
+	store, err := mock.New([]string{})
+	assert.NoError(t, err)
+
+	s := New(keyStore{Store: store})
+	for _, v := range []string{"v1", "v2"} {
+		err = s.Set(context.TODO(), "crypt_keys", []byte(v))
+		assert.NoError(t, err)
+	}
+	val, err := store.Get(context.TODO(), "crypt_keys.history.1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	list, err := s.List(context.TODO(), "crypt_keys")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	s = New(keyStore{Store: store, disabled: true})
+	err = s.Set(context.TODO(), "crypt_keys_disabled", []byte("v1"))
+	assert.NoError(t, err)
+	err = s.Set(context.TODO(), "crypt_keys_disabled", []byte("v2"))
+	assert.NoError(t, err)
+	list, err = store.List(context.TODO(), "crypt_keys_disabled")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+	_, err = s.History(context.TODO(), "crypt_keys_disabled", 10)
+	assert.Error(t, err)
+}
+
+func TestChangeDepth(t *testing.T) {
+	store, err := mock.New([]string{})
+	assert.NoError(t, err)
+
+	s := New(store, WithDepth(2))
+	for _, v := range []string{"v1", "v2", "v3", "v4"} {
+		err = s.Set(context.TODO(), "crypt_depth", []byte(v))
+		assert.NoError(t, err)
+	}
+
+	// revisions keep their values when the depth grows.
+	history, err := New(store, WithDepth(5)).History(context.TODO(), "crypt_depth", 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, int64(3), history[0].Index)
+	assert.Equal(t, []byte("v3"), history[0].Value)
+	assert.Equal(t, int64(2), history[1].Index)
+	assert.Equal(t, []byte("v2"), history[1].Value)
+
+	// and the older ones are removed when it shrinks.
+	s = New(store, WithDepth(1))
+	err = s.Set(context.TODO(), "crypt_depth", []byte("v5"))
+	assert.NoError(t, err)
+	history, err = s.History(context.TODO(), "crypt_depth", 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, []byte("v4"), history[0].Value)
+	_, err = store.Get(context.TODO(), "crypt_depth"+Separator+"3")
+	assert.True(t, errors.Is(err, backend.ErrNotFound))
+}
+
+// racingStore loses every CompareAndSet, like a store changed concurrently
+// between the read and the write.
+type racingStore struct {
+	backend.Store
+}
+
+func (racingStore) CompareAndSet(context.Context, string, []byte, backend.Version) error {
+	return backend.ErrVersionMismatch
+}
+
+func TestCompareAndSetMismatch(t *testing.T) {
+	store, err := mock.New([]string{})
+	assert.NoError(t, err)
+	err = store.Set(context.TODO(), "crypt_cas", []byte("v1"))
+	assert.NoError(t, err)
+	_, version, err := store.GetWithVersion(context.TODO(), "crypt_cas")
+	assert.NoError(t, err)
+
+	s := New(racingStore{store})
+	err = s.CompareAndSet(context.TODO(), "crypt_cas", []byte("v2"), version)
+	assert.Equal(t, backend.ErrVersionMismatch, err)
+	history, err := s.History(context.TODO(), "crypt_cas", 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 0)
+
+	s = New(store)
+	err = s.CompareAndSet(context.TODO(), "crypt_cas", []byte("v2"), version)
+	assert.NoError(t, err)
+	history, err = s.History(context.TODO(), "crypt_cas", 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, []byte("v1"), history[0].Value)
+}
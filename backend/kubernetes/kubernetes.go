@@ -0,0 +1,548 @@
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GGXXLL/crypt/backend"
+	"github.com/GGXXLL/crypt/internal"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	minRetryBackoff = 500 * time.Millisecond
+	maxRetryBackoff = 30 * time.Second
+
+	// managedByLabel marks the objects created by crypt, which are
+	// removed again once their last key is deleted.
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedBy      = "crypt"
+
+	// storeLabel marks all objects crypt wrote keys to, so listing
+	// doesn't need to read every object of the namespace.
+	storeLabel    = "crypt/store"
+	storeSelector = storeLabel + "=true"
+)
+
+var (
+	// errUnchanged is returned by the functions passed to change to skip
+	// the write.
+	errUnchanged = errors.New("unchanged")
+	// errExpired is returned by events if the resource version to watch
+	// from is too old and the state has to be listed again.
+	errExpired = errors.New("resource version expired")
+)
+
+// Client stores values in Secrets, or ConfigMaps, of a namespace. The key
+// "app/config" is the data key "config" of the object named "app", deeper
+// keys like "team/app/config" use the object "team.app". Keys therefore
+// need at least two segments, and segments of the object name must not
+// contain dots. Objects are labelled crypt/store=true when a key is
+// written to them; List and WatchPrefix only see labelled objects.
+type Client struct {
+	clientset  kubernetes.Interface
+	kubeconfig string
+	namespace  string
+	configMaps bool
+	res        resource
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+type OptionFunc func(client *Client)
+
+// WithNamespace sets the namespace of the objects. By default it is the
+// namespace of the kubeconfig context or of the pod running in-cluster.
+func WithNamespace(namespace string) OptionFunc {
+	return func(client *Client) {
+		client.namespace = namespace
+	}
+}
+
+// WithConfigMaps stores the values in ConfigMaps instead of Secrets.
+func WithConfigMaps() OptionFunc {
+	return func(client *Client) {
+		client.configMaps = true
+	}
+}
+
+// WithKubeconfig loads the cluster configuration from path instead of
+// $KUBECONFIG or ~/.kube/config.
+func WithKubeconfig(path string) OptionFunc {
+	return func(client *Client) {
+		client.kubeconfig = path
+	}
+}
+
+// WithClientset uses an existing clientset instead of creating one.
+func WithClientset(clientset kubernetes.Interface) OptionFunc {
+	return func(client *Client) {
+		client.clientset = clientset
+	}
+}
+
+// New creates a client for the Kubernetes API server configured by the
+// kubeconfig, falling back to the in-cluster configuration. A non-empty
+// machines[0] overrides the address of the API server.
+func New(machines []string, opts ...OptionFunc) (*Client, error) {
+	cli := &Client{minBackoff: minRetryBackoff, maxBackoff: maxRetryBackoff}
+	for _, opt := range opts {
+		opt(cli)
+	}
+	if cli.clientset == nil {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = cli.kubeconfig
+		overrides := &clientcmd.ConfigOverrides{}
+		if len(machines) > 0 {
+			overrides.ClusterInfo.Server = machines[0]
+		}
+		clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+		config, err := clientConfig.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("creating new kubernetes client for crypt.backend.Client: %v", err)
+		}
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("creating new kubernetes client for crypt.backend.Client: %v", err)
+		}
+		cli.clientset = clientset
+		if cli.namespace == "" {
+			if cli.namespace, _, err = clientConfig.Namespace(); err != nil {
+				return nil, fmt.Errorf("creating new kubernetes client for crypt.backend.Client: %v", err)
+			}
+		}
+	}
+	if cli.namespace == "" {
+		cli.namespace = metav1.NamespaceDefault
+	}
+	if cli.configMaps {
+		cli.res = &configMaps{client: cli.clientset.CoreV1().ConfigMaps(cli.namespace)}
+	} else {
+		cli.res = &secrets{client: cli.clientset.CoreV1().Secrets(cli.namespace)}
+	}
+	return cli, nil
+}
+
+// split returns the object name and data key of key.
+func split(key string) (string, string, error) {
+	trimmed := strings.Trim(key, "/")
+	i := strings.LastIndex(trimmed, "/")
+	if i <= 0 {
+		return "", "", fmt.Errorf("invalid key: %s, keys need an object name and a data key", key)
+	}
+	return strings.ReplaceAll(trimmed[:i], "/", "."), trimmed[i+1:], nil
+}
+
+// join returns the key of the data key of an object, starting with a slash
+// if slash is true.
+func join(name, dataKey string, slash bool) string {
+	key := strings.ReplaceAll(name, ".", "/") + "/" + dataKey
+	if slash {
+		key = "/" + key
+	}
+	return key
+}
+
+func version(value []byte) backend.Version {
+	return backend.Version(hex.EncodeToString(internal.GenMD5(value)))
+}
+
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := c.GetWithVersion(ctx, key)
+	return value, err
+}
+
+func (c *Client) Set(ctx context.Context, key string, value []byte) error {
+	name, dataKey, err := split(key)
+	if err != nil {
+		return err
+	}
+	return c.change(ctx, name, func(data map[string][]byte) error {
+		data[dataKey] = value
+		return nil
+	})
+}
+
+// GetWithVersion returns the value of key together with a hash of it. The
+// resource version of the object changes with every key of the object, so
+// it would make a poor version of a single key.
+func (c *Client) GetWithVersion(ctx context.Context, key string) ([]byte, backend.Version, error) {
+	name, dataKey, err := split(key)
+	if err != nil {
+		return nil, "", err
+	}
+	o, err := c.res.get(ctx, name)
+	if apierrors.IsNotFound(err) {
+		return nil, "", backend.NotFound(key)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	value, ok := o.data[dataKey]
+	if !ok {
+		return nil, "", backend.NotFound(key)
+	}
+	return value, version(value), nil
+}
+
+// CompareAndSet sets key only if its value still hashes to expected, or if
+// it does not exist and expected is empty. The object is updated with its
+// resource version, so the check is atomic.
+func (c *Client) CompareAndSet(ctx context.Context, key string, value []byte, expected backend.Version) error {
+	name, dataKey, err := split(key)
+	if err != nil {
+		return err
+	}
+	return c.change(ctx, name, func(data map[string][]byte) error {
+		current, ok := data[dataKey]
+		if ok != (expected != "") || (ok && version(current) != expected) {
+			return backend.ErrVersionMismatch
+		}
+		data[dataKey] = value
+		return nil
+	})
+}
+
+// Delete removes the data key of key. Objects created by crypt are deleted
+// together with their last key.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	name, dataKey, err := split(key)
+	if err != nil {
+		return err
+	}
+	return c.change(ctx, name, func(data map[string][]byte) error {
+		if _, ok := data[dataKey]; !ok {
+			return errUnchanged
+		}
+		delete(data, dataKey)
+		return nil
+	})
+}
+
+// HistoryKey returns no key: object names and data keys can't hold the
+// history ring keys, so no history is recorded.
+func (c *Client) HistoryKey(key, slot string) string {
+	return ""
+}
+
+// IsHistoryKey always reports false, see HistoryKey.
+func (c *Client) IsHistoryKey(key string) bool {
+	return false
+}
+
+// change applies fn to the data of the object name and writes the object
+// back, creating it if it does not exist. Writes conflicting with
+// concurrent changes of the object are retried.
+func (c *Client) change(ctx context.Context, name string, fn func(data map[string][]byte) error) error {
+	for {
+		o, err := c.res.get(ctx, name)
+		if apierrors.IsNotFound(err) {
+			data := map[string][]byte{}
+			if err := fn(data); err != nil {
+				if err == errUnchanged {
+					return nil
+				}
+				return err
+			}
+			err = c.res.create(ctx, &object{name: name, labels: map[string]string{managedByLabel: managedBy, storeLabel: "true"}, data: data})
+			if apierrors.IsAlreadyExists(err) {
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(o.data); err != nil {
+			if err == errUnchanged {
+				return nil
+			}
+			return err
+		}
+		if len(o.data) == 0 && o.labels[managedByLabel] == managedBy {
+			err = c.res.delete(ctx, o)
+		} else {
+			if o.labels[storeLabel] != "true" {
+				labels := map[string]string{}
+				for k, v := range o.labels {
+					labels[k] = v
+				}
+				labels[storeLabel] = "true"
+				o.labels = labels
+			}
+			err = c.res.update(ctx, o)
+		}
+		if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+			continue
+		}
+		return err
+	}
+}
+
+// List returns the keys starting with prefix of all objects in the
+// namespace labelled crypt/store=true.
+func (c *Client) List(ctx context.Context, prefix string) (backend.KVPairs, error) {
+	list, _, err := c.list(ctx, prefix)
+	return list, err
+}
+
+func (c *Client) list(ctx context.Context, prefix string) (backend.KVPairs, string, error) {
+	objects, resourceVersion, err := c.res.list(ctx, metav1.ListOptions{LabelSelector: storeSelector})
+	if err != nil {
+		return nil, "", err
+	}
+	list := backend.KVPairs{}
+	for _, o := range objects {
+		list = append(list, pairs(o, prefix)...)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, resourceVersion, nil
+}
+
+// pairs returns the keys of o starting with prefix.
+func pairs(o *object, prefix string) backend.KVPairs {
+	list := backend.KVPairs{}
+	for dataKey, value := range o.data {
+		key := join(o.name, dataKey, strings.HasPrefix(prefix, "/"))
+		if strings.HasPrefix(key, prefix) {
+			list = append(list, &backend.KVPair{Key: key, Value: value})
+		}
+	}
+	return list
+}
+
+// Watch follows the object of key with the Kubernetes watch API and
+// reports changes of the value of key. Removal of the key is reported as
+// an error.
+func (c *Client) Watch(ctx context.Context, key string) <-chan *backend.Response {
+	respChan := make(chan *backend.Response, 0)
+	name, dataKey, err := split(key)
+	if err != nil {
+		go func() {
+			defer close(respChan)
+			respChan <- &backend.Response{Error: err}
+		}()
+		return respChan
+	}
+
+	var current []byte
+	var exists bool
+	var resourceVersion string
+	if o, err := c.res.get(ctx, name); err == nil {
+		current, exists = o.data[dataKey]
+		resourceVersion = o.resourceVersion
+	}
+	opts := metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String()}
+	update := func(t watch.EventType, o *object) {
+		if o.name != name {
+			return
+		}
+		value, ok := o.data[dataKey]
+		if t == watch.Deleted || !ok {
+			if exists {
+				exists = false
+				respChan <- &backend.Response{Error: backend.NotFound(key)}
+			}
+			return
+		}
+		if exists && bytes.Equal(value, current) {
+			return
+		}
+		current, exists = value, true
+		respChan <- &backend.Response{Value: value}
+	}
+	resync := func(objects []*object) {
+		if len(objects) > 0 {
+			update(watch.Modified, objects[0])
+			return
+		}
+		update(watch.Deleted, &object{name: name})
+	}
+	w, err := c.res.watch(ctx, withResourceVersion(opts, resourceVersion))
+	go func() {
+		defer close(respChan)
+		c.watch(ctx, opts, resourceVersion, w, err, update, resync, func(err error) {
+			respChan <- &backend.Response{Error: err}
+		})
+	}()
+	return respChan
+}
+
+// WatchPrefix follows the objects of the namespace labelled
+// crypt/store=true with the Kubernetes watch API and reports changes of
+// the keys starting with prefix.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string) <-chan *backend.Event {
+	eventChan := make(chan *backend.Event, 0)
+	list, resourceVersion, err := c.list(ctx, prefix)
+	// the values of the keys by object name
+	cache := map[string]map[string][]byte{}
+	for _, kv := range list {
+		name, dataKey, _ := split(kv.Key)
+		if cache[name] == nil {
+			cache[name] = map[string][]byte{}
+		}
+		cache[name][dataKey] = kv.Value
+	}
+	opts := metav1.ListOptions{LabelSelector: storeSelector}
+	var w watch.Interface
+	if err == nil {
+		w, err = c.res.watch(ctx, withResourceVersion(opts, resourceVersion))
+	}
+	slash := strings.HasPrefix(prefix, "/")
+	update := func(t watch.EventType, o *object) {
+		current := map[string][]byte{}
+		if t != watch.Deleted {
+			for _, kv := range pairs(o, prefix) {
+				_, dataKey, _ := split(kv.Key)
+				current[dataKey] = kv.Value
+			}
+		}
+		previous := cache[o.name]
+		for _, dataKey := range sortedKeys(previous) {
+			if _, ok := current[dataKey]; !ok {
+				eventChan <- &backend.Event{Type: backend.EventDelete, Key: join(o.name, dataKey, slash)}
+			}
+		}
+		for _, dataKey := range sortedKeys(current) {
+			if value, ok := previous[dataKey]; !ok || !bytes.Equal(value, current[dataKey]) {
+				eventChan <- &backend.Event{Type: backend.EventPut, Key: join(o.name, dataKey, slash), Value: current[dataKey]}
+			}
+		}
+		if len(current) == 0 {
+			delete(cache, o.name)
+		} else {
+			cache[o.name] = current
+		}
+	}
+	// resync compares the listed objects to the cache, objects missing
+	// from the list were deleted while the watch was gone.
+	resync := func(objects []*object) {
+		listed := map[string]bool{}
+		for _, o := range objects {
+			listed[o.name] = true
+			update(watch.Modified, o)
+		}
+		var deleted []string
+		for name := range cache {
+			if !listed[name] {
+				deleted = append(deleted, name)
+			}
+		}
+		sort.Strings(deleted)
+		for _, name := range deleted {
+			update(watch.Deleted, &object{name: name})
+		}
+	}
+	go func() {
+		defer close(eventChan)
+		c.watch(ctx, opts, resourceVersion, w, err, update, resync, func(err error) {
+			eventChan <- &backend.Event{Error: err}
+		})
+	}()
+	return eventChan
+}
+
+func sortedKeys(data map[string][]byte) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func withResourceVersion(opts metav1.ListOptions, resourceVersion string) metav1.ListOptions {
+	opts.ResourceVersion = resourceVersion
+	return opts
+}
+
+// watch passes the objects of the events delivered by w to update until
+// ctx is done. When the API server ends the watch it is started again from
+// the last resource version seen. If that version expired, the objects
+// matching opts are listed and passed to resync before watching from the
+// version of the list. Errors, including err of starting w, are reported
+// and the watch is started again with backoff.
+func (c *Client) watch(ctx context.Context, opts metav1.ListOptions, resourceVersion string, w watch.Interface, err error, update func(watch.EventType, *object), resync func([]*object), report func(error)) {
+	var delay time.Duration
+	var expired bool
+	for {
+		if err == nil {
+			resourceVersion, err = c.events(ctx, w, resourceVersion, update)
+			w.Stop()
+			if ctx.Err() != nil {
+				report(ctx.Err())
+				return
+			}
+			if err == errExpired {
+				expired, err = true, nil
+			}
+			if err == nil {
+				delay = 0
+			}
+		}
+		if err != nil {
+			report(err)
+			delay = internal.Backoff(delay, c.minBackoff, c.maxBackoff)
+			if !internal.Sleep(ctx, delay) {
+				report(ctx.Err())
+				return
+			}
+		}
+		if expired {
+			var objects []*object
+			var listed string
+			if objects, listed, err = c.res.list(ctx, opts); err != nil {
+				continue
+			}
+			expired, resourceVersion = false, listed
+			resync(objects)
+		}
+		w, err = c.res.watch(ctx, withResourceVersion(opts, resourceVersion))
+		if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+			expired = true
+		}
+	}
+}
+
+// events passes the objects of the events delivered by w to update until
+// w ends or ctx is done, and returns the resource version to watch from
+// next. errExpired is returned if the API server no longer has the events
+// since resourceVersion.
+func (c *Client) events(ctx context.Context, w watch.Interface, resourceVersion string, update func(watch.EventType, *object)) (string, error) {
+	for {
+		select {
+		case e, ok := <-w.ResultChan():
+			if !ok {
+				return resourceVersion, nil
+			}
+			if e.Type == watch.Error {
+				err := apierrors.FromObject(e.Object)
+				if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+					return "", errExpired
+				}
+				return resourceVersion, err
+			}
+			o := c.res.decode(e.Object)
+			if o == nil {
+				continue
+			}
+			if o.resourceVersion != "" {
+				resourceVersion = o.resourceVersion
+			}
+			update(e.Type, o)
+		case <-ctx.Done():
+			return resourceVersion, ctx.Err()
+		}
+	}
+}
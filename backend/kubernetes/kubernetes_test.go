@@ -0,0 +1,178 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/GGXXLL/crypt/backend"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSplit(t *testing.T) {
+	name, dataKey, err := split("/team/app/config.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "team.app", name)
+	assert.Equal(t, "config.json", dataKey)
+	assert.Equal(t, "/team/app/config.json", join(name, dataKey, true))
+
+	_, _, err = split("/config")
+	assert.Error(t, err)
+}
+
+func TestClient(t *testing.T) {
+	for _, configMaps := range []bool{false, true} {
+		opts := []OptionFunc{WithClientset(fake.NewSimpleClientset()), WithNamespace("crypt")}
+		if configMaps {
+			opts = append(opts, WithConfigMaps())
+		}
+		client, err := New(nil, opts...)
+		assert.NoError(t, err)
+		testClient(t, client)
+	}
+}
+
+func testClient(t *testing.T, client *Client) {
+	err := client.Set(context.TODO(), "crypt/test", []byte("test"))
+	assert.NoError(t, err)
+
+	val, err := client.Get(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+
+	_, version, err := client.GetWithVersion(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("cas"), version)
+	assert.NoError(t, err)
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("cas"), version)
+	assert.Equal(t, backend.ErrVersionMismatch, err)
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("cas"), "")
+	assert.Equal(t, backend.ErrVersionMismatch, err)
+
+	err = client.Set(context.TODO(), "crypt/nested/test", []byte("nested"))
+	assert.NoError(t, err)
+	list, err := client.List(context.TODO(), "/crypt/")
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+	assert.Equal(t, "/crypt/nested/test", list[0].Key)
+	assert.Equal(t, []byte("nested"), list[0].Value)
+	assert.Equal(t, "/crypt/test", list[1].Key)
+	assert.Equal(t, []byte("cas"), list[1].Value)
+
+	// objects created by crypt are removed with their last key.
+	err = client.Delete(context.TODO(), "crypt/nested/test")
+	assert.NoError(t, err)
+	_, err = client.Get(context.TODO(), "crypt/nested/test")
+	assert.Error(t, err)
+	_, err = client.res.get(context.TODO(), "crypt.nested")
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := client.Watch(ctx, "crypt/test")
+	events := client.WatchPrefix(ctx, "crypt/")
+
+	err = client.Set(context.TODO(), "crypt/test", []byte("update"))
+	assert.NoError(t, err)
+
+	var r *backend.Response
+	r = <-resp
+	assert.NoError(t, r.Error)
+	assert.Equal(t, []byte("update"), r.Value)
+
+	e := <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventPut, e.Type)
+	assert.Equal(t, "crypt/test", e.Key)
+	assert.Equal(t, []byte("update"), e.Value)
+
+	err = client.Delete(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+
+	r = <-resp
+	assert.True(t, errors.Is(r.Error, backend.ErrNotFound))
+	e = <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventDelete, e.Type)
+	assert.Equal(t, "crypt/test", e.Key)
+
+	cancel()
+	r = <-resp
+	assert.Error(t, r.Error)
+	e = <-events
+	assert.Error(t, e.Error)
+}
+
+func TestExistingObject(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "crypt"},
+		Data:       map[string]string{"config": "text", "other": "kept"},
+	})
+	client, err := New(nil, WithClientset(clientset), WithNamespace("crypt"), WithConfigMaps())
+	assert.NoError(t, err)
+
+	val, err := client.Get(context.TODO(), "app/config")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("text"), val)
+
+	// objects are listed once crypt wrote to them.
+	list, err := client.List(context.TODO(), "app/")
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+	err = client.Set(context.TODO(), "app/config", []byte{0xff})
+	assert.NoError(t, err)
+	list, err = client.List(context.TODO(), "app/")
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+	err = client.Delete(context.TODO(), "app/other")
+	assert.NoError(t, err)
+
+	// objects not created by crypt are kept even without keys.
+	err = client.Delete(context.TODO(), "app/config")
+	assert.NoError(t, err)
+	configMap, err := clientset.CoreV1().ConfigMaps("crypt").Get(context.TODO(), "app", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, configMap.Data)
+	assert.Empty(t, configMap.BinaryData)
+}
+
+func TestWatchPrefixExpired(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	client, err := New(nil, WithClientset(clientset), WithNamespace("crypt"))
+	assert.NoError(t, err)
+	err = client.Set(context.TODO(), "app/config", []byte("config"))
+	assert.NoError(t, err)
+	err = client.Set(context.TODO(), "other/config", []byte("other"))
+	assert.NoError(t, err)
+
+	// the first watch expires, later ones use the fake clientset.
+	expiring := watch.NewFake()
+	watches := 0
+	clientset.PrependWatchReactor("secrets", func(k8stesting.Action) (bool, watch.Interface, error) {
+		watches++
+		return watches == 1, expiring, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := client.WatchPrefix(ctx, "")
+
+	// deleted while the watch is gone
+	err = clientset.CoreV1().Secrets("crypt").Delete(context.TODO(), "other", metav1.DeleteOptions{})
+	assert.NoError(t, err)
+	expiring.Error(&metav1.Status{Status: metav1.StatusFailure, Code: 410, Reason: metav1.StatusReasonGone})
+
+	e := <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventDelete, e.Type)
+	assert.Equal(t, "other/config", e.Key)
+
+	cancel()
+	e = <-events
+	assert.Error(t, e.Error)
+}
@@ -0,0 +1,187 @@
+package kubernetes
+
+import (
+	"context"
+	"unicode/utf8"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// object is the part of a Secret or ConfigMap crypt works with. raw keeps
+// the API object so updates preserve everything else.
+type object struct {
+	name            string
+	resourceVersion string
+	labels          map[string]string
+	data            map[string][]byte
+	raw             runtime.Object
+}
+
+// resource hides whether keys are stored in Secrets or ConfigMaps.
+type resource interface {
+	get(ctx context.Context, name string) (*object, error)
+	create(ctx context.Context, o *object) error
+	update(ctx context.Context, o *object) error
+	delete(ctx context.Context, o *object) error
+	list(ctx context.Context, opts metav1.ListOptions) ([]*object, string, error)
+	watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error)
+	// decode returns the object of a watch event, or nil if it has an
+	// unexpected type.
+	decode(obj runtime.Object) *object
+}
+
+type secrets struct {
+	client typedcorev1.SecretInterface
+}
+
+func (s *secrets) get(ctx context.Context, name string) (*object, error) {
+	secret, err := s.client.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return s.decode(secret), nil
+}
+
+func (s *secrets) create(ctx context.Context, o *object) error {
+	_, err := s.client.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: o.name, Labels: o.labels},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       o.data,
+	}, metav1.CreateOptions{})
+	return err
+}
+
+func (s *secrets) update(ctx context.Context, o *object) error {
+	secret := o.raw.(*corev1.Secret).DeepCopy()
+	secret.Labels = o.labels
+	secret.Data = o.data
+	_, err := s.client.Update(ctx, secret, metav1.UpdateOptions{})
+	return err
+}
+
+func (s *secrets) delete(ctx context.Context, o *object) error {
+	return s.client.Delete(ctx, o.name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &o.resourceVersion},
+	})
+}
+
+func (s *secrets) list(ctx context.Context, opts metav1.ListOptions) ([]*object, string, error) {
+	list, err := s.client.List(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	objects := make([]*object, 0, len(list.Items))
+	for i := range list.Items {
+		objects = append(objects, s.decode(&list.Items[i]))
+	}
+	return objects, list.ResourceVersion, nil
+}
+
+func (s *secrets) watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	return s.client.Watch(ctx, opts)
+}
+
+func (s *secrets) decode(obj runtime.Object) *object {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return nil
+	}
+	data := make(map[string][]byte, len(secret.Data))
+	for k, v := range secret.Data {
+		data[k] = v
+	}
+	return &object{
+		name:            secret.Name,
+		resourceVersion: secret.ResourceVersion,
+		labels:          secret.Labels,
+		data:            data,
+		raw:             secret,
+	}
+}
+
+type configMaps struct {
+	client typedcorev1.ConfigMapInterface
+}
+
+func (c *configMaps) get(ctx context.Context, name string) (*object, error) {
+	configMap, err := c.client.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return c.decode(configMap), nil
+}
+
+func (c *configMaps) create(ctx context.Context, o *object) error {
+	_, err := c.client.Create(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: o.name, Labels: o.labels},
+		BinaryData: o.data,
+	}, metav1.CreateOptions{})
+	return err
+}
+
+// update writes the values to binaryData, except values of keys already in
+// data which are still valid UTF-8.
+func (c *configMaps) update(ctx context.Context, o *object) error {
+	configMap := o.raw.(*corev1.ConfigMap).DeepCopy()
+	data := map[string]string{}
+	binaryData := map[string][]byte{}
+	for k, v := range o.data {
+		if _, ok := configMap.Data[k]; ok && utf8.Valid(v) {
+			data[k] = string(v)
+			continue
+		}
+		binaryData[k] = v
+	}
+	configMap.Labels = o.labels
+	configMap.Data = data
+	configMap.BinaryData = binaryData
+	_, err := c.client.Update(ctx, configMap, metav1.UpdateOptions{})
+	return err
+}
+
+func (c *configMaps) delete(ctx context.Context, o *object) error {
+	return c.client.Delete(ctx, o.name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &o.resourceVersion},
+	})
+}
+
+func (c *configMaps) list(ctx context.Context, opts metav1.ListOptions) ([]*object, string, error) {
+	list, err := c.client.List(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	objects := make([]*object, 0, len(list.Items))
+	for i := range list.Items {
+		objects = append(objects, c.decode(&list.Items[i]))
+	}
+	return objects, list.ResourceVersion, nil
+}
+
+func (c *configMaps) watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	return c.client.Watch(ctx, opts)
+}
+
+func (c *configMaps) decode(obj runtime.Object) *object {
+	configMap, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return nil
+	}
+	data := make(map[string][]byte, len(configMap.Data)+len(configMap.BinaryData))
+	for k, v := range configMap.Data {
+		data[k] = []byte(v)
+	}
+	for k, v := range configMap.BinaryData {
+		data[k] = v
+	}
+	return &object{
+		name:            configMap.Name,
+		resourceVersion: configMap.ResourceVersion,
+		labels:          configMap.Labels,
+		data:            data,
+		raw:             configMap,
+	}
+}
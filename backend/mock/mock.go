@@ -3,6 +3,9 @@ package mock
 import (
 	"context"
 	"errors"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,7 +14,9 @@ import (
 )
 
 var (
-	mockedStore map[string][]byte
+	mockedStore    map[string][]byte
+	mockedVersions map[string]int64
+	revision       int64
 
 	once = sync.Once{}
 	lock = sync.RWMutex{}
@@ -24,6 +29,7 @@ type Client struct {
 func New(_ []string) (*Client, error) {
 	once.Do(func() {
 		mockedStore = make(map[string][]byte, 2)
+		mockedVersions = make(map[string]int64, 2)
 	})
 	return &Client{cache: &sync.Map{}}, nil
 }
@@ -35,18 +41,149 @@ func (c *Client) Get(_ context.Context, key string) ([]byte, error) {
 	if v, ok := mockedStore[key]; ok {
 		return v, nil
 	}
-	err := errors.New("Could not find key: " + key)
-	return nil, err
+	return nil, backend.NotFound(key)
 }
 
 func (c *Client) Set(_ context.Context, key string, value []byte) error {
 	lock.Lock()
 	defer lock.Unlock()
 
+	set(key, value)
+	return nil
+}
+
+// SetWithTTL sets key to value and removes it after ttl, unless it was
+// changed in the meantime.
+func (c *Client) SetWithTTL(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	set(key, value)
+	version := mockedVersions[key]
+	time.AfterFunc(ttl, func() {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if mockedVersions[key] == version {
+			delete(mockedStore, key)
+			delete(mockedVersions, key)
+		}
+	})
+	return nil
+}
+
+// Lease returns a lease which removes its keys when it is revoked or ctx
+// is done. Mocked leases don't expire on their own.
+func (c *Client) Lease(ctx context.Context, _ time.Duration) (backend.Lease, error) {
+	l := &lease{versions: map[string]int64{}, done: make(chan struct{})}
+	go func() {
+		<-ctx.Done()
+		l.Revoke(context.Background())
+	}()
+	return l, nil
+}
+
+type lease struct {
+	versions map[string]int64
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (l *lease) Set(_ context.Context, key string, value []byte) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	select {
+	case <-l.done:
+		return errors.New("lease revoked")
+	default:
+	}
+	set(key, value)
+	l.versions[key] = mockedVersions[key]
+	return nil
+}
+
+// Revoke removes the keys of the lease which were not changed since.
+func (l *lease) Revoke(_ context.Context) error {
+	l.once.Do(func() {
+		lock.Lock()
+		defer lock.Unlock()
+
+		for key, version := range l.versions {
+			if mockedVersions[key] == version {
+				delete(mockedStore, key)
+				delete(mockedVersions, key)
+			}
+		}
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *lease) Done() <-chan struct{} {
+	return l.done
+}
+
+// set stores value and bumps the version of key. The caller must hold lock.
+func set(key string, value []byte) {
+	revision++
 	mockedStore[key] = value
+	mockedVersions[key] = revision
+}
+
+func (c *Client) GetWithVersion(_ context.Context, key string) ([]byte, backend.Version, error) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	if v, ok := mockedStore[key]; ok {
+		return v, backend.Version(strconv.FormatInt(mockedVersions[key], 10)), nil
+	}
+	return nil, "", backend.NotFound(key)
+}
+
+func (c *Client) CompareAndSet(_ context.Context, key string, value []byte, expected backend.Version) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	var current backend.Version
+	if _, ok := mockedStore[key]; ok {
+		current = backend.Version(strconv.FormatInt(mockedVersions[key], 10))
+	}
+	if current != expected {
+		return backend.ErrVersionMismatch
+	}
+	set(key, value)
+	return nil
+}
+
+func (c *Client) Delete(_ context.Context, key string) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	delete(mockedStore, key)
+	delete(mockedVersions, key)
 	return nil
 }
 
+func (c *Client) List(_ context.Context, prefix string) (backend.KVPairs, error) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	keys := make([]string, 0)
+	for k := range mockedStore {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	list := make(backend.KVPairs, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, &backend.KVPair{Key: k, Value: mockedStore[k]})
+	}
+	return list, nil
+}
+
 func (c *Client) Watch(ctx context.Context, key string) <-chan *backend.Response {
 	lock.RLock()
 	defer lock.RUnlock()
@@ -72,3 +209,30 @@ func (c *Client) Watch(ctx context.Context, key string) <-chan *backend.Response
 	}()
 	return respChan
 }
+
+func (c *Client) WatchPrefix(ctx context.Context, prefix string) <-chan *backend.Event {
+	eventChan := make(chan *backend.Event, 0)
+	list, err := c.List(ctx, prefix)
+	cache := internal.NewPrefixCache(list)
+	go func() {
+		defer close(eventChan)
+		if err != nil {
+			eventChan <- &backend.Event{Error: err}
+		}
+		for {
+			select {
+			case <-time.After(1 * time.Second):
+				list, err := c.List(ctx, prefix)
+				if err != nil {
+					eventChan <- &backend.Event{Error: err}
+					continue
+				}
+				internal.WatchPrefixCache(cache, list, eventChan)
+			case <-ctx.Done():
+				eventChan <- &backend.Event{Error: ctx.Err()}
+				return
+			}
+		}
+	}()
+	return eventChan
+}
@@ -0,0 +1,277 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GGXXLL/crypt/backend"
+	"github.com/GGXXLL/crypt/internal"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	minRetryBackoff = 500 * time.Millisecond
+	maxRetryBackoff = 30 * time.Second
+)
+
+// Client stores values in a NATS JetStream key-value bucket.
+type Client struct {
+	conn       *nats.Conn
+	kv         nats.KeyValue
+	bucket     string
+	history    uint8
+	options    []nats.Option
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+type OptionFunc func(client *Client)
+
+// WithBucket sets the key-value bucket, "crypt" by default. The bucket is
+// created if it does not exist.
+func WithBucket(bucket string) OptionFunc {
+	return func(client *Client) {
+		client.bucket = bucket
+	}
+}
+
+// WithHistory sets how many values per key a newly created bucket keeps,
+// including the current one. It has no effect on existing buckets.
+func WithHistory(history uint8) OptionFunc {
+	return func(client *Client) {
+		client.history = history
+	}
+}
+
+// WithOptions passes connection options like credentials or TLS settings
+// to the NATS client.
+func WithOptions(options ...nats.Option) OptionFunc {
+	return func(client *Client) {
+		client.options = append(client.options, options...)
+	}
+}
+
+// New connects to the NATS servers at machines and binds to the bucket.
+func New(machines []string, opts ...OptionFunc) (*Client, error) {
+	cli := &Client{
+		bucket:     "crypt",
+		history:    10,
+		minBackoff: minRetryBackoff,
+		maxBackoff: maxRetryBackoff,
+	}
+	for _, opt := range opts {
+		opt(cli)
+	}
+	conn, err := nats.Connect(strings.Join(machines, ","), cli.options...)
+	if err != nil {
+		return nil, fmt.Errorf("creating new nats client for crypt.backend.Client: %v", err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("creating new nats client for crypt.backend.Client: %v", err)
+	}
+	kv, err := js.KeyValue(cli.bucket)
+	if err == nats.ErrBucketNotFound {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: cli.bucket, History: cli.history})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("binding bucket %s for crypt.backend.Client: %v", cli.bucket, err)
+	}
+	cli.conn = conn
+	cli.kv = kv
+	return cli, nil
+}
+
+// Close closes the connection to the NATS servers.
+func (c *Client) Close() {
+	c.conn.Close()
+}
+
+func (c *Client) Get(_ context.Context, key string) ([]byte, error) {
+	entry, err := c.kv.Get(key)
+	if err == nats.ErrKeyNotFound {
+		return nil, backend.NotFound(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value(), nil
+}
+
+func (c *Client) Set(_ context.Context, key string, value []byte) error {
+	_, err := c.kv.Put(key, value)
+	return err
+}
+
+// GetWithVersion returns the value of key together with its revision in
+// the bucket.
+func (c *Client) GetWithVersion(_ context.Context, key string) ([]byte, backend.Version, error) {
+	entry, err := c.kv.Get(key)
+	if err == nats.ErrKeyNotFound {
+		return nil, "", backend.NotFound(key)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return entry.Value(), backend.Version(strconv.FormatUint(entry.Revision(), 10)), nil
+}
+
+// CompareAndSet updates key only if its latest revision is expected, or
+// creates it if expected is empty.
+func (c *Client) CompareAndSet(_ context.Context, key string, value []byte, expected backend.Version) error {
+	var err error
+	if expected == "" {
+		_, err = c.kv.Create(key, value)
+	} else {
+		revision, perr := strconv.ParseUint(string(expected), 10, 64)
+		if perr != nil {
+			return fmt.Errorf("invalid nats revision %q: %v", expected, perr)
+		}
+		_, err = c.kv.Update(key, value, revision)
+	}
+	if err != nil && strings.Contains(err.Error(), "wrong last sequence") {
+		return backend.ErrVersionMismatch
+	}
+	return err
+}
+
+// Delete places a delete marker for key, keeping its previous values in
+// the history of the bucket.
+func (c *Client) Delete(_ context.Context, key string) error {
+	return c.kv.Delete(key)
+}
+
+// History returns up to limit previous values of key from the bucket,
+// newest first. Delete markers are skipped.
+func (c *Client) History(_ context.Context, key string, limit int) ([]*backend.Revision, error) {
+	entries, err := c.kv.History(key)
+	if err == nats.ErrKeyNotFound {
+		return nil, backend.NotFound(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	history := make([]*backend.Revision, 0, limit)
+	// the last entry is the current value
+	for i := len(entries) - 2; i >= 0 && len(history) < limit; i-- {
+		if entries[i].Operation() != nats.KeyValuePut {
+			continue
+		}
+		history = append(history, &backend.Revision{Index: int64(entries[i].Revision()), Value: entries[i].Value()})
+	}
+	return history, nil
+}
+
+// List returns the latest values of all keys in the bucket starting with
+// prefix.
+func (c *Client) List(ctx context.Context, prefix string) (backend.KVPairs, error) {
+	watcher, err := c.kv.WatchAll(nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+
+	list := backend.KVPairs{}
+	for {
+		select {
+		case entry := <-watcher.Updates():
+			// nil marks the end of the current values
+			if entry == nil {
+				sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+				return list, nil
+			}
+			if strings.HasPrefix(entry.Key(), prefix) {
+				list = append(list, &backend.KVPair{Key: entry.Key(), Value: entry.Value()})
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Watch subscribes to the updates of key in the bucket. The current value
+// is not reported, only later changes are. Deletion of the key is reported
+// as an error.
+func (c *Client) Watch(ctx context.Context, key string) <-chan *backend.Response {
+	respChan := make(chan *backend.Response, 0)
+	watcher, err := c.kv.Watch(key)
+	go func() {
+		defer close(respChan)
+		c.watch(ctx, key, watcher, err, func(entry nats.KeyValueEntry) {
+			if entry.Operation() == nats.KeyValuePut {
+				respChan <- &backend.Response{Value: entry.Value()}
+				return
+			}
+			respChan <- &backend.Response{Error: backend.NotFound(key)}
+		}, func(err error) {
+			respChan <- &backend.Response{Error: err}
+		})
+	}()
+	return respChan
+}
+
+// WatchPrefix subscribes to the updates of all keys in the bucket and
+// reports those of keys starting with prefix. Bucket keys are single
+// subject tokens unless they contain dots, so prefixes can't be matched by
+// a subject wildcard.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string) <-chan *backend.Event {
+	eventChan := make(chan *backend.Event, 0)
+	watcher, err := c.kv.WatchAll()
+	go func() {
+		defer close(eventChan)
+		c.watch(ctx, nats.AllKeys, watcher, err, func(entry nats.KeyValueEntry) {
+			if !strings.HasPrefix(entry.Key(), prefix) {
+				return
+			}
+			if entry.Operation() == nats.KeyValuePut {
+				eventChan <- &backend.Event{Type: backend.EventPut, Key: entry.Key(), Value: entry.Value()}
+				return
+			}
+			eventChan <- &backend.Event{Type: backend.EventDelete, Key: entry.Key()}
+		}, func(err error) {
+			eventChan <- &backend.Event{Error: err}
+		})
+	}()
+	return eventChan
+}
+
+// watch calls update for every change delivered by watcher until ctx is
+// done. The initial values delivered by the watcher are skipped. If the
+// watcher couldn't be created, err is reported and creating it is retried
+// with backoff.
+func (c *Client) watch(ctx context.Context, subject string, watcher nats.KeyWatcher, err error, update func(nats.KeyValueEntry), report func(error)) {
+	var delay time.Duration
+	for err != nil {
+		report(err)
+		delay = internal.Backoff(delay, c.minBackoff, c.maxBackoff)
+		if !internal.Sleep(ctx, delay) {
+			report(ctx.Err())
+			return
+		}
+		watcher, err = c.kv.Watch(subject)
+	}
+	defer watcher.Stop()
+
+	initialized := false
+	for {
+		select {
+		case entry := <-watcher.Updates():
+			if entry == nil {
+				initialized = true
+				continue
+			}
+			if initialized {
+				update(entry)
+			}
+		case <-ctx.Done():
+			report(ctx.Err())
+			return
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/GGXXLL/crypt/backend"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+)
+
+// runServer starts an in-process nats-server with JetStream enabled.
+func runServer(t *testing.T) *server.Server {
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats-server not ready for connections")
+	}
+	t.Cleanup(srv.Shutdown)
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	srv := runServer(t)
+
+	client, err := New([]string{srv.ClientURL()})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	err = client.Set(context.TODO(), "crypt/test", []byte("test"))
+	assert.NoError(t, err)
+
+	val, err := client.Get(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+
+	val, version, err := client.GetWithVersion(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("cas"), version)
+	assert.NoError(t, err)
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("cas"), version)
+	assert.Equal(t, backend.ErrVersionMismatch, err)
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("cas"), "")
+	assert.Equal(t, backend.ErrVersionMismatch, err)
+
+	history, err := client.History(context.TODO(), "crypt/test", 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, []byte("test"), history[0].Value)
+
+	err = client.Set(context.TODO(), "crypt/nested/test", []byte("nested"))
+	assert.NoError(t, err)
+	err = client.Set(context.TODO(), "other", []byte("other"))
+	assert.NoError(t, err)
+	list, err := client.List(context.TODO(), "crypt/")
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+	assert.Equal(t, "crypt/nested/test", list[0].Key)
+	assert.Equal(t, []byte("nested"), list[0].Value)
+	assert.Equal(t, "crypt/test", list[1].Key)
+	assert.Equal(t, []byte("cas"), list[1].Value)
+
+	err = client.Delete(context.TODO(), "crypt/nested/test")
+	assert.NoError(t, err)
+	_, err = client.Get(context.TODO(), "crypt/nested/test")
+	assert.Error(t, err)
+	list, err = client.List(context.TODO(), "crypt/")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := client.Watch(ctx, "crypt/test")
+	events := client.WatchPrefix(ctx, "crypt/")
+
+	err = client.Set(context.TODO(), "crypt/test", []byte("update"))
+	assert.NoError(t, err)
+
+	var r *backend.Response
+	r = <-resp
+	assert.NoError(t, r.Error)
+	assert.Equal(t, []byte("update"), r.Value)
+
+	e := <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventPut, e.Type)
+	assert.Equal(t, "crypt/test", e.Key)
+	assert.Equal(t, []byte("update"), e.Value)
+
+	err = client.Delete(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+
+	r = <-resp
+	assert.True(t, errors.Is(r.Error, backend.ErrNotFound))
+	e = <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventDelete, e.Type)
+	assert.Equal(t, "crypt/test", e.Key)
+
+	cancel()
+	r = <-resp
+	assert.Error(t, r.Error)
+	e = <-events
+	assert.Error(t, e.Error)
+}
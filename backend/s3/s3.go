@@ -0,0 +1,381 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GGXXLL/crypt/backend"
+)
+
+var (
+	// errNotFound is returned by do when S3 answers with 404.
+	errNotFound = errors.New("not found")
+	// errPrecondition is returned by do when a conditional write failed.
+	errPrecondition = errors.New("precondition failed")
+)
+
+// Client stores every key as an object of a bucket. Objects are addressed
+// path-style, which S3 as well as MinIO and most other S3-compatible
+// stores support.
+type Client struct {
+	endpoint      string
+	bucket        string
+	region        string
+	creds         *credentials
+	httpClient    *http.Client
+	watchInterval time.Duration
+}
+
+type OptionFunc func(client *Client)
+
+func WithWatchInterval(duration time.Duration) OptionFunc {
+	return func(client *Client) {
+		client.watchInterval = duration
+	}
+}
+
+// WithBucket sets the bucket. By default it is the first path segment of
+// the endpoint, like "crypt" of "http://127.0.0.1:9000/crypt", or "crypt"
+// if the endpoint has no path.
+func WithBucket(bucket string) OptionFunc {
+	return func(client *Client) {
+		client.bucket = bucket
+	}
+}
+
+// WithRegion sets the region requests are signed for, AWS_REGION or
+// "us-east-1" by default.
+func WithRegion(region string) OptionFunc {
+	return func(client *Client) {
+		client.region = region
+	}
+}
+
+// WithCredentials sets the access keys requests are signed with. Without
+// it they are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN.
+func WithCredentials(accessKey, secretKey, sessionToken string) OptionFunc {
+	return func(client *Client) {
+		client.creds = &credentials{accessKey: accessKey, secretKey: secretKey, sessionToken: sessionToken}
+	}
+}
+
+func WithHTTPClient(httpClient *http.Client) OptionFunc {
+	return func(client *Client) {
+		client.httpClient = httpClient
+	}
+}
+
+// New creates a client for the S3 endpoint machines[0], e.g.
+// "https://s3.eu-west-1.amazonaws.com/bucket" or a MinIO server.
+func New(machines []string, opts ...OptionFunc) (*Client, error) {
+	if len(machines) == 0 {
+		return nil, errors.New("s3 endpoint should be defined")
+	}
+	u, err := url.Parse(machines[0])
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", machines[0])
+	}
+	cli := &Client{
+		endpoint:      u.Scheme + "://" + u.Host,
+		bucket:        "crypt",
+		region:        os.Getenv("AWS_REGION"),
+		httpClient:    &http.Client{Timeout: time.Minute},
+		watchInterval: 10 * time.Second,
+	}
+	if bucket := strings.Split(strings.Trim(u.Path, "/"), "/")[0]; bucket != "" {
+		cli.bucket = bucket
+	}
+	if cli.region == "" {
+		cli.region = "us-east-1"
+	}
+	for _, opt := range opts {
+		opt(cli)
+	}
+	if cli.creds == nil {
+		cli.creds = &credentials{
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+	return cli, nil
+}
+
+// response is the part of an S3 answer the client uses.
+type response struct {
+	etag string
+	body []byte
+}
+
+// do sends a signed request for the object key, or for the bucket if key
+// is empty.
+func (c *Client) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*response, error) {
+	u := c.endpoint + "/" + uriEncode(c.bucket, true)
+	if key != "" {
+		u += "/" + uriEncode(key, false)
+	}
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Amz-Content-Sha256", hashHex(body))
+	if c.creds.accessKey != "" {
+		sign(req, c.creds, c.region, time.Now())
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, errNotFound
+	case resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict:
+		// 409 is returned for conditional writes racing each other.
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, errPrecondition
+	case resp.StatusCode >= 300:
+		var e struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		xml.NewDecoder(resp.Body).Decode(&e)
+		return nil, fmt.Errorf("s3: %s %s: %d %s %s", method, key, resp.StatusCode, e.Code, e.Message)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &response{etag: strings.Trim(resp.Header.Get("ETag"), `"`), body: data}, nil
+}
+
+// object returns the name of the object of key. Leading slashes are
+// dropped, like the file backend does.
+func object(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
+
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := c.GetWithVersion(ctx, key)
+	return value, err
+}
+
+func (c *Client) Set(ctx context.Context, key string, value []byte) error {
+	_, err := c.do(ctx, http.MethodPut, object(key), nil, nil, value)
+	return err
+}
+
+// GetWithVersion returns the value of key together with the ETag of its
+// object.
+func (c *Client) GetWithVersion(ctx context.Context, key string) ([]byte, backend.Version, error) {
+	resp, err := c.do(ctx, http.MethodGet, object(key), nil, nil, nil)
+	if err == errNotFound {
+		return nil, "", backend.NotFound(key)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.body, backend.Version(resp.etag), nil
+}
+
+// CompareAndSet writes the object of key with If-Match on expected, or
+// with If-None-Match if expected is empty, so the object is only created.
+func (c *Client) CompareAndSet(ctx context.Context, key string, value []byte, expected backend.Version) error {
+	header := http.Header{}
+	if expected == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", `"`+string(expected)+`"`)
+	}
+	_, err := c.do(ctx, http.MethodPut, object(key), nil, header, value)
+	if err == errPrecondition || (err == errNotFound && expected != "") {
+		return backend.ErrVersionMismatch
+	}
+	return err
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, object(key), nil, nil, nil)
+	if err == errNotFound {
+		return nil
+	}
+	return err
+}
+
+type listResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		ETag string `xml:"ETag"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// etags returns the ETags of all objects starting with prefix by their
+// key.
+func (c *Client) etags(ctx context.Context, prefix string) (map[string]string, error) {
+	etags := map[string]string{}
+	query := url.Values{"list-type": {"2"}, "prefix": {object(prefix)}}
+	for {
+		resp, err := c.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listResult
+		if err := xml.Unmarshal(resp.body, &result); err != nil {
+			return nil, err
+		}
+		for _, o := range result.Contents {
+			key := o.Key
+			if strings.HasPrefix(prefix, "/") {
+				key = "/" + key
+			}
+			etags[key] = strings.Trim(o.ETag, `"`)
+		}
+		if !result.IsTruncated {
+			return etags, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (c *Client) List(ctx context.Context, prefix string) (backend.KVPairs, error) {
+	etags, err := c.etags(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	list := backend.KVPairs{}
+	for _, key := range sortedKeys(etags) {
+		value, err := c.Get(ctx, key)
+		if errors.Is(err, backend.ErrNotFound) {
+			// removed while listing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, &backend.KVPair{Key: key, Value: value})
+	}
+	return list, nil
+}
+
+// Watch checks the ETag of the object of key every watchInterval and
+// reports its value when the ETag changed. Removal of the object is
+// reported as an error.
+func (c *Client) Watch(ctx context.Context, key string) <-chan *backend.Response {
+	respChan := make(chan *backend.Response, 0)
+	var current string
+	if resp, err := c.do(ctx, http.MethodHead, object(key), nil, nil, nil); err == nil {
+		current = resp.etag
+	}
+	go func() {
+		defer close(respChan)
+		for {
+			select {
+			case <-time.After(c.watchInterval):
+				resp, err := c.do(ctx, http.MethodHead, object(key), nil, nil, nil)
+				if err == errNotFound {
+					if current != "" {
+						current = ""
+						respChan <- &backend.Response{Error: backend.NotFound(key)}
+					}
+					continue
+				}
+				if err != nil {
+					respChan <- &backend.Response{Error: err}
+					continue
+				}
+				if resp.etag == current {
+					continue
+				}
+				value, version, err := c.GetWithVersion(ctx, key)
+				if err != nil {
+					respChan <- &backend.Response{Error: err}
+					continue
+				}
+				current = string(version)
+				respChan <- &backend.Response{Value: value}
+			case <-ctx.Done():
+				respChan <- &backend.Response{Error: ctx.Err()}
+				return
+			}
+		}
+	}()
+	return respChan
+}
+
+// WatchPrefix lists the ETags of the objects starting with prefix every
+// watchInterval and only reads the objects whose ETag changed.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string) <-chan *backend.Event {
+	eventChan := make(chan *backend.Event, 0)
+	cache, err := c.etags(ctx, prefix)
+	go func() {
+		defer close(eventChan)
+		if err != nil {
+			cache = map[string]string{}
+			eventChan <- &backend.Event{Error: err}
+		}
+		for {
+			select {
+			case <-time.After(c.watchInterval):
+				etags, err := c.etags(ctx, prefix)
+				if err != nil {
+					eventChan <- &backend.Event{Error: err}
+					continue
+				}
+				for _, key := range sortedKeys(cache) {
+					if _, ok := etags[key]; !ok {
+						delete(cache, key)
+						eventChan <- &backend.Event{Type: backend.EventDelete, Key: key}
+					}
+				}
+				for _, key := range sortedKeys(etags) {
+					if cache[key] == etags[key] {
+						continue
+					}
+					value, version, err := c.GetWithVersion(ctx, key)
+					if err != nil {
+						// removed since listing, reported by the next poll
+						continue
+					}
+					cache[key] = string(version)
+					eventChan <- &backend.Event{Type: backend.EventPut, Key: key, Value: value}
+				}
+			case <-ctx.Done():
+				eventChan <- &backend.Event{Error: ctx.Err()}
+				return
+			}
+		}
+	}()
+	return eventChan
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
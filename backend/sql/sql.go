@@ -0,0 +1,319 @@
+package sql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GGXXLL/crypt/backend"
+	"github.com/GGXXLL/crypt/internal"
+)
+
+// dialect holds what differs between the supported databases.
+type dialect struct {
+	// bind returns the placeholder of the n-th query argument.
+	bind func(n int) string
+	// quote quotes an identifier, "key" is reserved in MySQL.
+	quote     func(name string) string
+	blob      string
+	timestamp string
+}
+
+func question(int) string { return "?" }
+
+func dollar(n int) string { return "$" + strconv.Itoa(n) }
+
+func doubleQuote(name string) string { return `"` + name + `"` }
+
+func backQuote(name string) string { return "`" + name + "`" }
+
+var (
+	sqlite   = &dialect{bind: question, quote: doubleQuote, blob: "BLOB", timestamp: "TIMESTAMP"}
+	postgres = &dialect{bind: dollar, quote: doubleQuote, blob: "BYTEA", timestamp: "TIMESTAMP"}
+	mysql    = &dialect{bind: question, quote: backQuote, blob: "LONGBLOB", timestamp: "DATETIME(6)"}
+)
+
+// dialects maps the names drivers register with database/sql to their
+// dialect.
+var dialects = map[string]*dialect{
+	"sqlite3":  sqlite,
+	"sqlite":   sqlite,
+	"postgres": postgres,
+	"pgx":      postgres,
+	"mysql":    mysql,
+}
+
+// Client stores every key as a row of the crypt_kv table. The version of
+// a row starts at 1 and is incremented on every change. Deleting a key
+// only marks its row as deleted, so setting the key again continues its
+// versions instead of starting over at 1.
+type Client struct {
+	db            *sql.DB
+	driver        string
+	table         string
+	dialect       *dialect
+	watchInterval time.Duration
+}
+
+type OptionFunc func(client *Client)
+
+func WithWatchInterval(duration time.Duration) OptionFunc {
+	return func(client *Client) {
+		client.watchInterval = duration
+	}
+}
+
+// WithDriver sets the database/sql driver, "sqlite3" by default. The
+// driver has to be registered by importing it, crypt does not import any.
+// sqlite3, sqlite, postgres, pgx and mysql are supported.
+func WithDriver(driver string) OptionFunc {
+	return func(client *Client) {
+		client.driver = driver
+	}
+}
+
+// WithTable sets the table the keys are stored in, "crypt_kv" by default.
+func WithTable(table string) OptionFunc {
+	return func(client *Client) {
+		client.table = table
+	}
+}
+
+// New opens the database with the data source name machines[0] and
+// creates the table if it does not exist.
+func New(machines []string, opts ...OptionFunc) (*Client, error) {
+	if len(machines) == 0 {
+		return nil, errors.New("data source name should be defined")
+	}
+	cli := &Client{driver: "sqlite3", table: "crypt_kv", watchInterval: 10 * time.Second}
+	for _, opt := range opts {
+		opt(cli)
+	}
+	d, ok := dialects[cli.driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sql driver %s", cli.driver)
+	}
+	cli.dialect = d
+	db, err := sql.Open(cli.driver, machines[0])
+	if err != nil {
+		return nil, fmt.Errorf("creating new sql client for crypt.backend.Client: %v", err)
+	}
+	cli.db = db
+	if err := cli.migrate(context.TODO()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating table %s for crypt.backend.Client: %v", cli.table, err)
+	}
+	return cli, nil
+}
+
+// Close closes the database.
+func (c *Client) Close() error {
+	return c.db.Close()
+}
+
+func (c *Client) migrate(ctx context.Context) error {
+	_, err := c.db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (%s VARCHAR(255) NOT NULL PRIMARY KEY, value %s NOT NULL, version BIGINT NOT NULL, deleted SMALLINT NOT NULL DEFAULT 0, updated_at %s NOT NULL)",
+		c.dialect.quote(c.table), c.dialect.quote("key"), c.dialect.blob, c.dialect.timestamp,
+	))
+	return err
+}
+
+// query replaces the placeholders {table}, {key} and ? of q for the
+// dialect of the client.
+func (c *Client) query(q string) string {
+	q = strings.NewReplacer("{table}", c.dialect.quote(c.table), "{key}", c.dialect.quote("key")).Replace(q)
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			b.WriteString(c.dialect.bind(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := c.GetWithVersion(ctx, key)
+	return value, err
+}
+
+// Set updates the row of key and increments its version, or inserts the
+// row if it does not exist.
+func (c *Client) Set(ctx context.Context, key string, value []byte) error {
+	for i := 0; ; i++ {
+		res, err := c.db.ExecContext(ctx, c.query("UPDATE {table} SET value = ?, version = version + 1, deleted = 0, updated_at = ? WHERE {key} = ?"), value, time.Now().UTC(), key)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+		err = c.insert(ctx, key, value)
+		if err == nil || i > 0 {
+			return err
+		}
+		// inserted concurrently, try to update it again
+	}
+}
+
+func (c *Client) insert(ctx context.Context, key string, value []byte) error {
+	_, err := c.db.ExecContext(ctx, c.query("INSERT INTO {table} ({key}, value, version, updated_at) VALUES (?, ?, 1, ?)"), key, value, time.Now().UTC())
+	return err
+}
+
+// GetWithVersion returns the value of key together with the version of
+// its row.
+func (c *Client) GetWithVersion(ctx context.Context, key string) ([]byte, backend.Version, error) {
+	var value []byte
+	var version int64
+	err := c.db.QueryRowContext(ctx, c.query("SELECT value, version FROM {table} WHERE {key} = ? AND deleted = 0"), key).Scan(&value, &version)
+	if err == sql.ErrNoRows {
+		return nil, "", backend.NotFound(key)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return value, backend.Version(strconv.FormatInt(version, 10)), nil
+}
+
+// CompareAndSet updates the row of key only if it is still at version
+// expected, or inserts it if expected is empty.
+func (c *Client) CompareAndSet(ctx context.Context, key string, value []byte, expected backend.Version) error {
+	if expected == "" {
+		// a deleted row is set again
+		res, err := c.db.ExecContext(ctx, c.query("UPDATE {table} SET value = ?, version = version + 1, deleted = 0, updated_at = ? WHERE {key} = ? AND deleted = 1"), value, time.Now().UTC(), key)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+		err = c.insert(ctx, key, value)
+		if err == nil {
+			return nil
+		}
+		// the insert failed either because the row exists or for some
+		// other reason, which is reported as is.
+		if _, _, gerr := c.GetWithVersion(ctx, key); gerr == nil {
+			return backend.ErrVersionMismatch
+		}
+		return err
+	}
+	version, err := strconv.ParseInt(string(expected), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sql version %q: %v", expected, err)
+	}
+	res, err := c.db.ExecContext(ctx, c.query("UPDATE {table} SET value = ?, version = version + 1, updated_at = ? WHERE {key} = ? AND version = ? AND deleted = 0"), value, time.Now().UTC(), key, version)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return backend.ErrVersionMismatch
+	}
+	return nil
+}
+
+// Delete marks the row of key as deleted and increments its version.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.db.ExecContext(ctx, c.query("UPDATE {table} SET value = ?, version = version + 1, deleted = 1, updated_at = ? WHERE {key} = ? AND deleted = 0"), []byte{}, time.Now().UTC(), key)
+	return err
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern with "!", which
+// unlike "\" needs no escaping in the string literals of any dialect.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+func (c *Client) List(ctx context.Context, prefix string) (backend.KVPairs, error) {
+	rows, err := c.db.QueryContext(ctx, c.query("SELECT {key}, value FROM {table} WHERE {key} LIKE ? ESCAPE '!' AND deleted = 0 ORDER BY {key}"), likeEscaper.Replace(prefix)+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := backend.KVPairs{}
+	for rows.Next() {
+		kv := &backend.KVPair{}
+		if err := rows.Scan(&kv.Key, &kv.Value); err != nil {
+			return nil, err
+		}
+		list = append(list, kv)
+	}
+	return list, rows.Err()
+}
+
+// Watch polls the row of key every watchInterval and reports changes of
+// its version or value. Removal of the row is reported as an error, as
+// are failed reads, which keep the last seen version.
+func (c *Client) Watch(ctx context.Context, key string) <-chan *backend.Response {
+	respChan := make(chan *backend.Response, 0)
+	current, version, _ := c.GetWithVersion(ctx, key)
+	go func() {
+		defer close(respChan)
+		for {
+			select {
+			case <-time.After(c.watchInterval):
+				value, v, err := c.GetWithVersion(ctx, key)
+				if errors.Is(err, backend.ErrNotFound) {
+					if version != "" {
+						version = ""
+						respChan <- &backend.Response{Error: err}
+					}
+					continue
+				}
+				if err != nil {
+					respChan <- &backend.Response{Error: err}
+					continue
+				}
+				if v == version && bytes.Equal(value, current) {
+					continue
+				}
+				current, version = value, v
+				respChan <- &backend.Response{Value: value}
+			case <-ctx.Done():
+				respChan <- &backend.Response{Error: ctx.Err()}
+				return
+			}
+		}
+	}()
+	return respChan
+}
+
+func (c *Client) WatchPrefix(ctx context.Context, prefix string) <-chan *backend.Event {
+	eventChan := make(chan *backend.Event, 0)
+	list, err := c.List(ctx, prefix)
+	cache := internal.NewPrefixCache(list)
+	go func() {
+		defer close(eventChan)
+		if err != nil {
+			eventChan <- &backend.Event{Error: err}
+		}
+		for {
+			select {
+			case <-time.After(c.watchInterval):
+				list, err := c.List(ctx, prefix)
+				if err != nil {
+					eventChan <- &backend.Event{Error: err}
+					continue
+				}
+				internal.WatchPrefixCache(cache, list, eventChan)
+			case <-ctx.Done():
+				eventChan <- &backend.Event{Error: ctx.Err()}
+				return
+			}
+		}
+	}()
+	return eventChan
+}
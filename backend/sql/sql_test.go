@@ -0,0 +1,118 @@
+package sql
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GGXXLL/crypt/backend"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "crypt.db")
+	client, err := New([]string{dsn}, WithWatchInterval(10*time.Millisecond))
+	assert.NoError(t, err)
+	defer client.Close()
+
+	// migrating an existing table is a no-op
+	other, err := New([]string{dsn})
+	assert.NoError(t, err)
+	other.Close()
+
+	err = client.Set(context.TODO(), "crypt/test", []byte("test"))
+	assert.NoError(t, err)
+
+	val, version, err := client.GetWithVersion(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+	assert.Equal(t, backend.Version("1"), version)
+
+	err = client.Set(context.TODO(), "crypt/test", []byte("again"))
+	assert.NoError(t, err)
+	val, version, err = client.GetWithVersion(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("again"), val)
+	assert.Equal(t, backend.Version("2"), version)
+
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("cas"), version)
+	assert.NoError(t, err)
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("cas"), version)
+	assert.Equal(t, backend.ErrVersionMismatch, err)
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("cas"), "")
+	assert.Equal(t, backend.ErrVersionMismatch, err)
+
+	err = client.Set(context.TODO(), "crypt/nested/test", []byte("nested"))
+	assert.NoError(t, err)
+	err = client.Set(context.TODO(), "crypt_test", []byte("wildcard"))
+	assert.NoError(t, err)
+	list, err := client.List(context.TODO(), "crypt/")
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+	assert.Equal(t, "crypt/nested/test", list[0].Key)
+	assert.Equal(t, []byte("nested"), list[0].Value)
+	assert.Equal(t, "crypt/test", list[1].Key)
+	assert.Equal(t, []byte("cas"), list[1].Value)
+
+	err = client.Delete(context.TODO(), "crypt/nested/test")
+	assert.NoError(t, err)
+	_, err = client.Get(context.TODO(), "crypt/nested/test")
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := client.Watch(ctx, "crypt/test")
+	events := client.WatchPrefix(ctx, "crypt/")
+
+	err = client.Set(context.TODO(), "crypt/test", []byte("update"))
+	assert.NoError(t, err)
+
+	var r *backend.Response
+	r = <-resp
+	assert.NoError(t, r.Error)
+	assert.Equal(t, []byte("update"), r.Value)
+
+	e := <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventPut, e.Type)
+	assert.Equal(t, "crypt/test", e.Key)
+	assert.Equal(t, []byte("update"), e.Value)
+
+	err = client.Delete(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+
+	r = <-resp
+	assert.Error(t, r.Error)
+	e = <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventDelete, e.Type)
+
+	// versions continue after a deletion
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("again"), "")
+	assert.NoError(t, err)
+	_, version, err = client.GetWithVersion(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+	assert.Equal(t, backend.Version("6"), version)
+	r = <-resp
+	assert.NoError(t, r.Error)
+	assert.Equal(t, []byte("again"), r.Value)
+	e = <-events
+	assert.NoError(t, e.Error)
+	assert.Equal(t, backend.EventPut, e.Type)
+
+	cancel()
+	r = <-resp
+	assert.Error(t, r.Error)
+	e = <-events
+	assert.Error(t, e.Error)
+}
+
+func TestQuery(t *testing.T) {
+	client := &Client{table: "crypt_kv", dialect: postgres}
+	assert.Equal(t, `SELECT value FROM "crypt_kv" WHERE "key" = $1 AND version = $2`, client.query("SELECT value FROM {table} WHERE {key} = ? AND version = ?"))
+
+	client.dialect = mysql
+	assert.Equal(t, "SELECT value FROM `crypt_kv` WHERE `key` = ?", client.query("SELECT value FROM {table} WHERE {key} = ?"))
+}
@@ -0,0 +1,536 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GGXXLL/crypt/backend"
+	"github.com/GGXXLL/crypt/internal"
+)
+
+var (
+	// errNotFound is returned by do when vault answers with 404.
+	errNotFound = errors.New("not found")
+	// errForbidden is returned by do when vault rejects the token.
+	errForbidden = errors.New("permission denied")
+)
+
+// Client stores values in a vault KV version 2 secrets engine. Every key is
+// a secret holding the value as a string in its "value" field.
+type Client struct {
+	address       string
+	mount         string
+	httpClient    *http.Client
+	watchInterval time.Duration
+	namespace     string
+	tlsConfig     *tls.Config
+	dialTimeout   time.Duration
+
+	mu       sync.RWMutex
+	token    string
+	roleID   string
+	secretID string
+}
+
+type OptionFunc func(client *Client)
+
+func WithWatchInterval(duration time.Duration) OptionFunc {
+	return func(client *Client) {
+		client.watchInterval = duration
+	}
+}
+
+// WithToken authenticates requests with a vault token. Without any
+// authentication option the AppRole credentials in VAULT_ROLE_ID and
+// VAULT_SECRET_ID or else the token in VAULT_TOKEN are used.
+func WithToken(token string) OptionFunc {
+	return func(client *Client) {
+		client.token = token
+	}
+}
+
+// WithAppRole logs in with the AppRole auth method. The login is repeated
+// whenever vault rejects the token, e.g. after it expired.
+func WithAppRole(roleID, secretID string) OptionFunc {
+	return func(client *Client) {
+		client.roleID = roleID
+		client.secretID = secretID
+	}
+}
+
+// WithMount sets the path the KV secrets engine is mounted at, "secret" by
+// default.
+func WithMount(mount string) OptionFunc {
+	return func(client *Client) {
+		client.mount = strings.Trim(mount, "/")
+	}
+}
+
+// WithNamespace sends requests to a vault enterprise namespace.
+func WithNamespace(namespace string) OptionFunc {
+	return func(client *Client) {
+		client.namespace = namespace
+	}
+}
+
+// WithTLS sets the TLS configuration of the connections to vault.
+func WithTLS(tlsConfig *tls.Config) OptionFunc {
+	return func(client *Client) {
+		client.tlsConfig = tlsConfig
+	}
+}
+
+// WithDialTimeout limits how long connecting to vault may take.
+func WithDialTimeout(timeout time.Duration) OptionFunc {
+	return func(client *Client) {
+		client.dialTimeout = timeout
+	}
+}
+
+// WithHTTPClient sets the HTTP client, WithTLS and WithDialTimeout only
+// apply if it has no transport.
+func WithHTTPClient(httpClient *http.Client) OptionFunc {
+	return func(client *Client) {
+		client.httpClient = httpClient
+	}
+}
+
+// New creates a client for the vault server at machines[0].
+func New(machines []string, opts ...OptionFunc) (*Client, error) {
+	if len(machines) == 0 {
+		return nil, errors.New("vault address should be defined")
+	}
+	cli := &Client{
+		address:       strings.TrimSuffix(machines[0], "/"),
+		mount:         "secret",
+		httpClient:    &http.Client{Timeout: time.Minute},
+		watchInterval: 10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(cli)
+	}
+	if (cli.tlsConfig != nil || cli.dialTimeout > 0) && cli.httpClient.Transport == nil {
+		httpClient := *cli.httpClient
+		httpClient.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			DialContext:     (&net.Dialer{Timeout: cli.dialTimeout}).DialContext,
+			TLSClientConfig: cli.tlsConfig,
+		}
+		cli.httpClient = &httpClient
+	}
+	if cli.token == "" && cli.roleID == "" {
+		cli.roleID = os.Getenv("VAULT_ROLE_ID")
+		cli.secretID = os.Getenv("VAULT_SECRET_ID")
+		cli.token = os.Getenv("VAULT_TOKEN")
+	}
+	if cli.roleID != "" {
+		if err := cli.login(context.TODO()); err != nil {
+			return nil, fmt.Errorf("creating new vault client for crypt.backend.Client: %v", err)
+		}
+	}
+	return cli, nil
+}
+
+func (c *Client) login(ctx context.Context) error {
+	body := map[string]string{"role_id": c.roleID, "secret_id": c.secretID}
+	var out struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := c.request(ctx, http.MethodPost, "/v1/auth/approle/login", body, &out, ""); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.token = out.Auth.ClientToken
+	c.mu.Unlock()
+	return nil
+}
+
+// do sends a request to vault and decodes the JSON answer into out. If the
+// token is rejected and AppRole credentials are set, it logs in again and
+// retries once.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	c.mu.RLock()
+	token := c.token
+	c.mu.RUnlock()
+
+	err := c.request(ctx, method, path, body, out, token)
+	if err == errForbidden && c.roleID != "" {
+		if err := c.login(ctx); err != nil {
+			return err
+		}
+		c.mu.RLock()
+		token = c.token
+		c.mu.RUnlock()
+		err = c.request(ctx, method, path, body, out, token)
+	}
+	return err
+}
+
+func (c *Client) request(ctx context.Context, method, path string, body, out interface{}, token string) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.address+path, r)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode == http.StatusForbidden:
+		return errForbidden
+	case resp.StatusCode >= 300:
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("vault: %s %s: %d %s", method, path, resp.StatusCode, strings.Join(e.Errors, ", "))
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) dataPath(key string) string {
+	return "/v1/" + c.mount + "/data/" + escapePath(key)
+}
+
+func (c *Client) metadataPath(key string) string {
+	return "/v1/" + c.mount + "/metadata/" + escapePath(key)
+}
+
+func escapePath(key string) string {
+	parts := strings.Split(strings.Trim(key, "/"), "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+type secret struct {
+	Data struct {
+		Data struct {
+			Value string `json:"value"`
+		} `json:"data"`
+		Metadata struct {
+			Version int64 `json:"version"`
+		} `json:"metadata"`
+	} `json:"data"`
+}
+
+// value returns the "value" field of the secret. It is a string, so secrets
+// written with the vault CLI or UI can be read.
+func (s *secret) value() []byte {
+	return []byte(s.Data.Data.Value)
+}
+
+// read returns the secret of key at version, the latest for version 0.
+func (c *Client) read(ctx context.Context, key string, version int64) (*secret, error) {
+	path := c.dataPath(key)
+	if version > 0 {
+		path += "?version=" + strconv.FormatInt(version, 10)
+	}
+	s := &secret{}
+	err := c.do(ctx, http.MethodGet, path, nil, s)
+	if err == errNotFound {
+		return nil, backend.NotFound(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	s, err := c.read(ctx, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	return s.value(), nil
+}
+
+func (c *Client) Set(ctx context.Context, key string, value []byte) error {
+	return c.write(ctx, key, value, nil)
+}
+
+func (c *Client) write(ctx context.Context, key string, value []byte, cas *int64) error {
+	body := map[string]interface{}{
+		"data": map[string]string{"value": string(value)},
+	}
+	if cas != nil {
+		body["options"] = map[string]int64{"cas": *cas}
+	}
+	return c.do(ctx, http.MethodPost, c.dataPath(key), body, nil)
+}
+
+// GetWithVersion returns the value of key together with its secret version.
+func (c *Client) GetWithVersion(ctx context.Context, key string) ([]byte, backend.Version, error) {
+	s, err := c.read(ctx, key, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.value(), backend.Version(strconv.FormatInt(s.Data.Metadata.Version, 10)), nil
+}
+
+// CompareAndSet writes value with the check-and-set option of KV v2. A
+// key whose latest version is deleted counts as not existing.
+func (c *Client) CompareAndSet(ctx context.Context, key string, value []byte, expected backend.Version) error {
+	var cas int64
+	var err error
+	if expected != "" {
+		cas, err = strconv.ParseInt(string(expected), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid vault version %q: %v", expected, err)
+		}
+	} else {
+		current, deleted, err := c.currentVersion(ctx, key)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			cas = current
+		}
+	}
+	err = c.write(ctx, key, value, &cas)
+	if err != nil && strings.Contains(err.Error(), "check-and-set") {
+		return backend.ErrVersionMismatch
+	}
+	return err
+}
+
+// Delete deletes the latest version of key. Its previous versions are
+// kept, so the key can still be rolled back; Purge removes them.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	err := c.do(ctx, http.MethodDelete, c.dataPath(key), nil, nil)
+	if err == errNotFound {
+		return nil
+	}
+	return err
+}
+
+// Purge removes key with all its versions.
+func (c *Client) Purge(ctx context.Context, key string) error {
+	err := c.do(ctx, http.MethodDelete, c.metadataPath(key), nil, nil)
+	if err == errNotFound {
+		return nil
+	}
+	return err
+}
+
+// History returns previous versions of key which have not been deleted or
+// destroyed. If the latest version is deleted, the versions before it are
+// returned.
+func (c *Client) History(ctx context.Context, key string, limit int) ([]*backend.Revision, error) {
+	current, deleted, err := c.currentVersion(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if current == 0 {
+		return nil, backend.NotFound(key)
+	}
+	from := current - 1
+	if deleted {
+		from = current
+	}
+	history := make([]*backend.Revision, 0, limit)
+	for v := from; v > 0 && len(history) < limit; v-- {
+		prev, err := c.read(ctx, key, v)
+		if errors.Is(err, backend.ErrNotFound) {
+			// deleted, destroyed or dropped by max_versions
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, &backend.Revision{Index: v, Value: prev.value()})
+	}
+	return history, nil
+}
+
+// keys lists the secrets below the folder dir recursively.
+func (c *Client) keys(ctx context.Context, dir string) ([]string, error) {
+	var out struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	path := "/v1/" + c.mount + "/metadata/"
+	if dir != "" {
+		path += escapePath(dir) + "/"
+	}
+	err := c.do(ctx, http.MethodGet, path+"?list=true", nil, &out)
+	if err == errNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, k := range out.Data.Keys {
+		if dir != "" {
+			k = dir + "/" + k
+		}
+		if !strings.HasSuffix(k, "/") {
+			keys = append(keys, k)
+			continue
+		}
+		sub, err := c.keys(ctx, strings.TrimSuffix(k, "/"))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, sub...)
+	}
+	return keys, nil
+}
+
+// List returns all secrets whose path starts with prefix.
+func (c *Client) List(ctx context.Context, prefix string) (backend.KVPairs, error) {
+	trimmed := strings.TrimPrefix(prefix, "/")
+	dir := ""
+	if i := strings.LastIndex(trimmed, "/"); i >= 0 {
+		dir = trimmed[:i]
+	}
+	keys, err := c.keys(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	list := backend.KVPairs{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, trimmed) {
+			continue
+		}
+		s, err := c.read(ctx, key, 0)
+		if errors.Is(err, backend.ErrNotFound) {
+			// the latest version is deleted
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(prefix, "/") {
+			key = "/" + key
+		}
+		list = append(list, &backend.KVPair{Key: key, Value: s.value()})
+	}
+	return list, nil
+}
+
+// currentVersion reads the metadata of key and returns its latest version,
+// zero if the key does not exist, and whether that version is deleted or
+// destroyed.
+func (c *Client) currentVersion(ctx context.Context, key string) (int64, bool, error) {
+	var out struct {
+		Data struct {
+			CurrentVersion int64 `json:"current_version"`
+			Versions       map[string]struct {
+				DeletionTime string `json:"deletion_time"`
+				Destroyed    bool   `json:"destroyed"`
+			} `json:"versions"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, c.metadataPath(key), nil, &out)
+	if err == errNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	latest := out.Data.Versions[strconv.FormatInt(out.Data.CurrentVersion, 10)]
+	return out.Data.CurrentVersion, latest.DeletionTime != "" || latest.Destroyed, nil
+}
+
+// Watch polls the metadata of key every watchInterval and reads the value
+// whenever a new version shows up or the latest one is deleted.
+func (c *Client) Watch(ctx context.Context, key string) <-chan *backend.Response {
+	respChan := make(chan *backend.Response, 0)
+	current, deleted, _ := c.currentVersion(ctx, key)
+	go func() {
+		defer close(respChan)
+		for {
+			select {
+			case <-time.After(c.watchInterval):
+				version, versionDeleted, err := c.currentVersion(ctx, key)
+				if err != nil {
+					respChan <- &backend.Response{Error: err}
+					continue
+				}
+				if version == current && versionDeleted == deleted {
+					continue
+				}
+				current, deleted = version, versionDeleted
+				val, err := c.Get(ctx, key)
+				respChan <- &backend.Response{Value: val, Error: err}
+			case <-ctx.Done():
+				respChan <- &backend.Response{Error: ctx.Err()}
+				return
+			}
+		}
+	}()
+	return respChan
+}
+
+func (c *Client) WatchPrefix(ctx context.Context, prefix string) <-chan *backend.Event {
+	eventChan := make(chan *backend.Event, 0)
+	list, err := c.List(ctx, prefix)
+	cache := internal.NewPrefixCache(list)
+	go func() {
+		defer close(eventChan)
+		if err != nil {
+			eventChan <- &backend.Event{Error: err}
+		}
+		for {
+			select {
+			case <-time.After(c.watchInterval):
+				list, err := c.List(ctx, prefix)
+				if err != nil {
+					eventChan <- &backend.Event{Error: err}
+					continue
+				}
+				internal.WatchPrefixCache(cache, list, eventChan)
+			case <-ctx.Done():
+				eventChan <- &backend.Event{Error: ctx.Err()}
+				return
+			}
+		}
+	}()
+	return eventChan
+}
@@ -0,0 +1,287 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GGXXLL/crypt/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeVault is a minimal in-memory stand-in of a vault server with AppRole
+// auth and a KV version 2 engine mounted at "secret".
+type fakeVault struct {
+	mu       sync.Mutex
+	token    string
+	logins   int
+	versions map[string][][]byte
+	// deleted holds the deleted versions of a key.
+	deleted map[string]map[int]bool
+	// broken is a key whose data can't be read.
+	broken    string
+	namespace string
+}
+
+func newFakeVault() *fakeVault {
+	return &fakeVault{versions: map[string][][]byte{}, deleted: map[string]map[int]bool{}}
+}
+
+func (f *fakeVault) expireToken() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.token = ""
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/v1/auth/approle/login" {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["role_id"] != "role" || body["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.logins++
+		f.token = "token-" + strconv.Itoa(f.logins)
+		reply(w, map[string]interface{}{"auth": map[string]string{"client_token": f.token}})
+		return
+	}
+	if f.token == "" || r.Header.Get("X-Vault-Token") != f.token {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	f.namespace = r.Header.Get("X-Vault-Namespace")
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		f.data(w, r, strings.TrimPrefix(r.URL.Path, "/v1/secret/data/"))
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/"):
+		f.metadata(w, r, strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeVault) data(w http.ResponseWriter, r *http.Request, key string) {
+	versions := f.versions[key]
+	switch r.Method {
+	case http.MethodGet:
+		if key == f.broken {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		version := len(versions)
+		if v := r.URL.Query().Get("version"); v != "" {
+			version, _ = strconv.Atoi(v)
+		}
+		if version == 0 || version > len(versions) || f.deleted[key][version] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		reply(w, map[string]interface{}{"data": map[string]interface{}{
+			"data":     map[string]string{"value": string(versions[version-1])},
+			"metadata": map[string]int{"version": version},
+		}})
+	case http.MethodPost:
+		var body struct {
+			Data    map[string]string `json:"data"`
+			Options *struct {
+				CAS int `json:"cas"`
+			} `json:"options"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Options != nil && body.Options.CAS != len(versions) {
+			w.WriteHeader(http.StatusBadRequest)
+			reply(w, map[string][]string{"errors": {"check-and-set parameter did not match the current version"}})
+			return
+		}
+		f.versions[key] = append(versions, []byte(body.Data["value"]))
+		reply(w, map[string]interface{}{"data": map[string]int{"version": len(f.versions[key])}})
+	case http.MethodDelete:
+		if len(versions) > 0 {
+			if f.deleted[key] == nil {
+				f.deleted[key] = map[int]bool{}
+			}
+			f.deleted[key][len(versions)] = true
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeVault) metadata(w http.ResponseWriter, r *http.Request, key string) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("list") == "true":
+		seen := map[string]bool{}
+		for k := range f.versions {
+			if !strings.HasPrefix(k, key) {
+				continue
+			}
+			rest := strings.TrimPrefix(k, key)
+			if i := strings.Index(rest, "/"); i >= 0 {
+				rest = rest[:i+1]
+			}
+			seen[rest] = true
+		}
+		if len(seen) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		keys := []string{}
+		for k := range seen {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		reply(w, map[string]interface{}{"data": map[string][]string{"keys": keys}})
+	case r.Method == http.MethodGet:
+		if _, ok := f.versions[key]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		versions := map[string]map[string]string{}
+		for v := range f.versions[key] {
+			deletion := ""
+			if f.deleted[key][v+1] {
+				deletion = "2021-01-01T00:00:00Z"
+			}
+			versions[strconv.Itoa(v+1)] = map[string]string{"deletion_time": deletion}
+		}
+		reply(w, map[string]interface{}{"data": map[string]interface{}{
+			"current_version": len(f.versions[key]),
+			"versions":        versions,
+		}})
+	case r.Method == http.MethodDelete:
+		delete(f.versions, key)
+		delete(f.deleted, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestClient(t *testing.T) {
+	vault := newFakeVault()
+	srv := httptest.NewServer(vault)
+	defer srv.Close()
+
+	client, err := New([]string{srv.URL}, WithAppRole("role", "secret"), WithWatchInterval(10*time.Millisecond))
+	assert.NoError(t, err)
+
+	err = client.Set(context.TODO(), "crypt/test", []byte("test"))
+	assert.NoError(t, err)
+
+	val, err := client.Get(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+
+	// the client logs in again once its token is rejected.
+	vault.expireToken()
+	val, version, err := client.GetWithVersion(context.TODO(), "crypt/test")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+	assert.Equal(t, backend.Version("1"), version)
+	assert.Equal(t, 2, vault.logins)
+
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("cas"), version)
+	assert.NoError(t, err)
+	err = client.CompareAndSet(context.TODO(), "crypt/test", []byte("cas"), version)
+	assert.Equal(t, backend.ErrVersionMismatch, err)
+
+	history, err := client.History(context.TODO(), "crypt/test", 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, int64(1), history[0].Index)
+	assert.Equal(t, []byte("test"), history[0].Value)
+
+	err = client.Set(context.TODO(), "crypt/nested/test", []byte("nested"))
+	assert.NoError(t, err)
+	list, err := client.List(context.TODO(), "crypt/")
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+	assert.Equal(t, "crypt/nested/test", list[0].Key)
+	assert.Equal(t, []byte("nested"), list[0].Value)
+	assert.Equal(t, "crypt/test", list[1].Key)
+	assert.Equal(t, []byte("cas"), list[1].Value)
+
+	err = client.Delete(context.TODO(), "crypt/nested/test")
+	assert.NoError(t, err)
+	_, err = client.Get(context.TODO(), "crypt/nested/test")
+	assert.True(t, errors.Is(err, backend.ErrNotFound))
+	list, err = client.List(context.TODO(), "crypt/")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	// deleted keys can be created again and keep their previous versions.
+	err = client.CompareAndSet(context.TODO(), "crypt/nested/test", []byte("again"), "")
+	assert.NoError(t, err)
+	err = client.Set(context.TODO(), "crypt/nested/test", []byte("latest"))
+	assert.NoError(t, err)
+	err = client.Delete(context.TODO(), "crypt/nested/test")
+	assert.NoError(t, err)
+	history, err = client.History(context.TODO(), "crypt/nested/test", 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, int64(2), history[0].Index)
+	assert.Equal(t, []byte("again"), history[0].Value)
+
+	err = client.Purge(context.TODO(), "crypt/nested/test")
+	assert.NoError(t, err)
+	_, err = client.History(context.TODO(), "crypt/nested/test", 10)
+	assert.True(t, errors.Is(err, backend.ErrNotFound))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := client.Watch(ctx, "crypt/test")
+
+	err = client.Set(context.TODO(), "crypt/test", []byte("update"))
+	assert.NoError(t, err)
+
+	var r *backend.Response
+	r = <-resp
+	assert.NoError(t, r.Error)
+	assert.Equal(t, []byte("update"), r.Value)
+
+	cancel()
+	r = <-resp
+	assert.Error(t, r.Error)
+}
+
+func TestErrors(t *testing.T) {
+	vault := newFakeVault()
+	srv := httptest.NewServer(vault)
+	defer srv.Close()
+
+	client, err := New([]string{srv.URL}, WithAppRole("role", "secret"), WithNamespace("team"))
+	assert.NoError(t, err)
+
+	// secrets written as plain strings, e.g. with the vault CLI, are read.
+	vault.versions["crypt/plain"] = [][]byte{[]byte("plain")}
+	val, err := client.Get(context.TODO(), "crypt/plain")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("plain"), val)
+	assert.Equal(t, "team", vault.namespace)
+
+	// only missing secrets are left out of lists.
+	vault.broken = "crypt/plain"
+	_, err = client.List(context.TODO(), "crypt/")
+	assert.Error(t, err)
+	_, err = client.History(context.TODO(), "crypt/plain", 10)
+	assert.NoError(t, err)
+	err = client.Set(context.TODO(), "crypt/plain", []byte("update"))
+	assert.NoError(t, err)
+	_, err = client.History(context.TODO(), "crypt/plain", 10)
+	assert.Error(t, err)
+}
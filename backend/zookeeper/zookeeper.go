@@ -0,0 +1,294 @@
+package zookeeper
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GGXXLL/crypt/backend"
+	"github.com/GGXXLL/crypt/internal"
+	"github.com/go-zookeeper/zk"
+)
+
+const (
+	minRetryBackoff = 500 * time.Millisecond
+	maxRetryBackoff = 30 * time.Second
+)
+
+// Client stores every key as the data of the znode with the same path.
+type Client struct {
+	conn           *zk.Conn
+	acl            []zk.ACL
+	sessionTimeout time.Duration
+	watchInterval  time.Duration
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+}
+
+type OptionFunc func(client *Client)
+
+// WithWatchInterval sets the polling interval of WatchPrefix. ZooKeeper
+// data watches don't cover whole subtrees, so prefixes are polled.
+func WithWatchInterval(duration time.Duration) OptionFunc {
+	return func(client *Client) {
+		client.watchInterval = duration
+	}
+}
+
+func WithSessionTimeout(duration time.Duration) OptionFunc {
+	return func(client *Client) {
+		client.sessionTimeout = duration
+	}
+}
+
+// WithACL sets the ACL of the znodes created by the client, open to
+// everyone by default.
+func WithACL(acl []zk.ACL) OptionFunc {
+	return func(client *Client) {
+		client.acl = acl
+	}
+}
+
+// New connects to the ZooKeeper ensemble at machines. The connection
+// re-establishes itself, creating a new session if the old one expired.
+func New(machines []string, opts ...OptionFunc) (*Client, error) {
+	cli := &Client{
+		acl:            zk.WorldACL(zk.PermAll),
+		sessionTimeout: 10 * time.Second,
+		watchInterval:  10 * time.Second,
+		minBackoff:     minRetryBackoff,
+		maxBackoff:     maxRetryBackoff,
+	}
+	for _, opt := range opts {
+		opt(cli)
+	}
+	conn, _, err := zk.Connect(machines, cli.sessionTimeout, zk.WithLogInfo(false))
+	if err != nil {
+		return nil, fmt.Errorf("creating new zookeeper client for crypt.backend.Client: %v", err)
+	}
+	cli.conn = conn
+	return cli, nil
+}
+
+func znode(key string) string {
+	return "/" + strings.Trim(key, "/")
+}
+
+func (c *Client) Get(_ context.Context, key string) ([]byte, error) {
+	data, _, err := c.conn.Get(znode(key))
+	if err == zk.ErrNoNode {
+		return nil, backend.NotFound(key)
+	}
+	return data, err
+}
+
+// Set writes value to the znode of key, creating it and its parents if
+// they don't exist.
+func (c *Client) Set(_ context.Context, key string, value []byte) error {
+	p := znode(key)
+	for {
+		_, err := c.conn.Set(p, value, -1)
+		if err != zk.ErrNoNode {
+			return err
+		}
+		err = c.create(p, value)
+		if err != zk.ErrNodeExists {
+			return err
+		}
+		// created concurrently, try to update it again
+	}
+}
+
+// create creates the znode p and all missing parents.
+func (c *Client) create(p string, value []byte) error {
+	parent := path.Dir(p)
+	if parent != "/" {
+		if _, err := c.conn.Create(parent, nil, 0, c.acl); err == zk.ErrNoNode {
+			if err := c.create(parent, nil); err != nil && err != zk.ErrNodeExists {
+				return err
+			}
+		} else if err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	_, err := c.conn.Create(p, value, 0, c.acl)
+	return err
+}
+
+// GetWithVersion returns the value of key together with the data version
+// of its znode.
+func (c *Client) GetWithVersion(_ context.Context, key string) ([]byte, backend.Version, error) {
+	data, stat, err := c.conn.Get(znode(key))
+	if err == zk.ErrNoNode {
+		return nil, "", backend.NotFound(key)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, backend.Version(strconv.FormatInt(int64(stat.Version), 10)), nil
+}
+
+// CompareAndSet sets the znode of key with a version check, or creates it
+// if expected is empty.
+func (c *Client) CompareAndSet(_ context.Context, key string, value []byte, expected backend.Version) error {
+	p := znode(key)
+	var err error
+	if expected == "" {
+		err = c.create(p, value)
+	} else {
+		version, perr := strconv.ParseInt(string(expected), 10, 32)
+		if perr != nil {
+			return fmt.Errorf("invalid zookeeper version %q: %v", expected, perr)
+		}
+		_, err = c.conn.Set(p, value, int32(version))
+	}
+	switch err {
+	case zk.ErrNodeExists, zk.ErrBadVersion, zk.ErrNoNode:
+		return backend.ErrVersionMismatch
+	}
+	return err
+}
+
+func (c *Client) Delete(_ context.Context, key string) error {
+	err := c.conn.Delete(znode(key), -1)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	return err
+}
+
+// List returns the znodes below the parent of prefix whose path starts with
+// prefix. Intermediate znodes without data are skipped.
+func (c *Client) List(_ context.Context, prefix string) (backend.KVPairs, error) {
+	p := znode(prefix)
+	dir := p
+	if !strings.HasSuffix(prefix, "/") {
+		dir = path.Dir(p)
+	}
+	list := backend.KVPairs{}
+	if err := c.walk(dir, p, &list); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		for _, kv := range list {
+			kv.Key = strings.TrimPrefix(kv.Key, "/")
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, nil
+}
+
+func (c *Client) walk(p, prefix string, list *backend.KVPairs) error {
+	children, _, err := c.conn.Children(p)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		childPath := path.Join(p, child)
+		if !strings.HasPrefix(childPath, prefix) && !strings.HasPrefix(prefix, childPath+"/") {
+			continue
+		}
+		if err := c.walk(childPath, prefix, list); err != nil {
+			return err
+		}
+	}
+	if p == "/" || !strings.HasPrefix(p, prefix) {
+		return nil
+	}
+	data, _, err := c.conn.Get(p)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 || len(children) == 0 {
+		*list = append(*list, &backend.KVPair{Key: p, Value: data})
+	}
+	return nil
+}
+
+// Watch arms a ZooKeeper watch on the znode of key and re-arms it after
+// every event. Changes are detected by the Mzxid of the znode, so changes
+// made while the watch is being re-armed are not lost. Watches dropped
+// because of an expired session are re-armed once the client reconnected.
+func (c *Client) Watch(ctx context.Context, key string) <-chan *backend.Response {
+	respChan := make(chan *backend.Response, 0)
+	p := znode(key)
+	var last int64
+	if ok, stat, err := c.conn.Exists(p); err == nil && ok {
+		last = stat.Mzxid
+	}
+	go func() {
+		defer close(respChan)
+		var delay time.Duration
+		for {
+			ok, stat, events, err := c.conn.ExistsW(p)
+			if err != nil {
+				respChan <- &backend.Response{Error: err}
+				delay = internal.Backoff(delay, c.minBackoff, c.maxBackoff)
+				if !internal.Sleep(ctx, delay) {
+					respChan <- &backend.Response{Error: ctx.Err()}
+					return
+				}
+				continue
+			}
+			delay = 0
+
+			var current int64
+			if ok {
+				current = stat.Mzxid
+			}
+			if current != last {
+				last = current
+				val, err := c.Get(ctx, key)
+				respChan <- &backend.Response{Value: val, Error: err}
+			}
+
+			select {
+			case e := <-events:
+				if e.Err != nil {
+					respChan <- &backend.Response{Error: e.Err}
+				}
+			case <-ctx.Done():
+				respChan <- &backend.Response{Error: ctx.Err()}
+				return
+			}
+		}
+	}()
+	return respChan
+}
+
+func (c *Client) WatchPrefix(ctx context.Context, prefix string) <-chan *backend.Event {
+	eventChan := make(chan *backend.Event, 0)
+	list, err := c.List(ctx, prefix)
+	cache := internal.NewPrefixCache(list)
+	go func() {
+		defer close(eventChan)
+		if err != nil {
+			eventChan <- &backend.Event{Error: err}
+		}
+		for {
+			select {
+			case <-time.After(c.watchInterval):
+				list, err := c.List(ctx, prefix)
+				if err != nil {
+					eventChan <- &backend.Event{Error: err}
+					continue
+				}
+				internal.WatchPrefixCache(cache, list, eventChan)
+			case <-ctx.Done():
+				eventChan <- &backend.Event{Error: ctx.Err()}
+				return
+			}
+		}
+	}()
+	return eventChan
+}
@@ -0,0 +1,64 @@
+package zookeeper
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GGXXLL/crypt/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient(t *testing.T) {
+	addr := os.Getenv("ZOOKEEPER_ADDR")
+	if addr == "" {
+		t.Skip()
+	}
+	client, err := New(strings.Split(addr, ","), WithWatchInterval(1*time.Second))
+	assert.NoError(t, err)
+
+	err = client.Set(context.TODO(), "/crypt/nested/test", []byte("test"))
+	assert.NoError(t, err)
+
+	val, err := client.Get(context.TODO(), "/crypt/nested/test")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+
+	list, err := client.List(context.TODO(), "/crypt/")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "/crypt/nested/test", list[0].Key)
+	assert.Equal(t, []byte("test"), list[0].Value)
+
+	_, version, err := client.GetWithVersion(context.TODO(), "/crypt/nested/test")
+	assert.NoError(t, err)
+	err = client.CompareAndSet(context.TODO(), "/crypt/nested/test", []byte("test"), version)
+	assert.NoError(t, err)
+	err = client.CompareAndSet(context.TODO(), "/crypt/nested/test", []byte("test"), version)
+	assert.Equal(t, backend.ErrVersionMismatch, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := client.Watch(ctx, "/crypt/nested/test")
+
+	// the watch has to be re-armed after each change.
+	for _, v := range []string{"update", "again"} {
+		err = client.Set(context.TODO(), "/crypt/nested/test", []byte(v))
+		assert.NoError(t, err)
+
+		r := <-resp
+		assert.NoError(t, r.Error)
+		assert.Equal(t, []byte(v), r.Value)
+	}
+
+	err = client.Delete(context.TODO(), "/crypt/nested/test")
+	assert.NoError(t, err)
+	r := <-resp
+	assert.Error(t, r.Error)
+
+	cancel()
+	r = <-resp
+	assert.Error(t, r.Error)
+}
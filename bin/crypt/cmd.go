@@ -8,11 +8,13 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/GGXXLL/crypt/backend"
-	"github.com/GGXXLL/crypt/backend/consul"
-	"github.com/GGXXLL/crypt/backend/etcd"
-	"github.com/GGXXLL/crypt/backend/redis"
+	"github.com/GGXXLL/crypt/backend/history"
+	"github.com/GGXXLL/crypt/config"
+	"github.com/GGXXLL/crypt/encoding"
+	"github.com/GGXXLL/crypt/encoding/age"
 	"github.com/GGXXLL/crypt/encoding/secconf"
 )
 
@@ -22,6 +24,9 @@ func getCmd(flagset *flag.FlagSet) {
 		flagset.PrintDefaults()
 	}
 	flagset.StringVar(&secretKeyring, "secret-keyring", ".secring.gpg", "path to armored secret keyring")
+	flagset.StringVar(&identity, "identity", ".age-identity", "path to the age identity or SSH private key")
+	flagset.StringVar(&trusted, "trusted-keyring", "", "path to armored keyring of the trusted signers, refuses values they did not sign")
+	flagset.BoolVar(&showVersion, "show-version", false, "print the version of the value to stderr")
 	flagset.Parse(os.Args[2:])
 	if key == "" {
 		flagset.Usage()
@@ -31,48 +36,60 @@ func getCmd(flagset *flag.FlagSet) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	if plaintext {
-		value, err := getPlain(key, backendStore)
+	// values of trusted signers are always verified
+	if plaintext && trusted == "" {
+		value, version, err := getPlain(key, backendStore)
 		if err != nil {
 			log.Fatal(err)
 		}
+		printVersion(version)
 		fmt.Printf("%s\n", value)
 		return
 	}
-	value, err := getEncrypted(key, secretKeyring, backendStore)
+	value, version, err := getEncrypted(key, secretKeyring, backendStore)
 
 	if err != nil {
 		log.Fatal(err)
 	}
+	printVersion(version)
 	fmt.Printf("%s\n", value)
 }
 
-func getEncrypted(key, keyring string, store backend.Store) ([]byte, error) {
-	var value []byte
-	kr, err := os.Open(secretKeyring)
-	if err != nil {
-		return value, err
+func printVersion(version backend.Version) {
+	if showVersion {
+		fmt.Fprintf(os.Stderr, "version: %s\n", version)
 	}
-	defer kr.Close()
-	data, err := store.Get(context.TODO(), key)
+}
+
+func getEncrypted(key, keyring string, store backend.Store) ([]byte, backend.Version, error) {
+	var value []byte
+	data, version, err := store.GetWithVersion(context.TODO(), key)
 	if err != nil {
-		return value, err
+		return value, "", err
 	}
-	value, err = secconf.Decode(data, kr)
+	value, err = decrypt(data, keyring)
 	if err != nil {
-		return value, err
+		return value, "", err
 	}
-	return value, err
+	return value, version, err
 
 }
 
-func getPlain(key string, store backend.Store) ([]byte, error) {
+// getPlain returns the value of key as it is stored. Values which are
+// recognizably encrypted are refused, as -plaintext was likely mis-set.
+func getPlain(key string, store backend.Store) ([]byte, backend.Version, error) {
 	var value []byte
-	data, err := store.Get(context.TODO(), key)
+	data, version, err := store.GetWithVersion(context.TODO(), key)
 	if err != nil {
-		return value, err
+		return value, "", err
+	}
+	if header, _, _ := encoding.ParseHeader(data); header != nil {
+		return value, "", fmt.Errorf("value of %s is encoded with %s, use -plaintext=false", key, header.Codec)
+	}
+	if age.IsEncrypted(data) {
+		return value, "", fmt.Errorf("value of %s is encrypted with age, use -plaintext=false", key)
 	}
-	return data, err
+	return data, version, err
 }
 
 func setCmd(flagset *flag.FlagSet) {
@@ -81,6 +98,11 @@ func setCmd(flagset *flag.FlagSet) {
 		flagset.PrintDefaults()
 	}
 	flagset.StringVar(&keyring, "keyring", ".pubring.gpg", "path to armored public keyring")
+	flagset.StringVar(&codec, "codec", "secconf", "encryption of the value, secconf (OpenPGP), secconf-signed (signed only) or age")
+	flagset.StringVar(&signerKeyring, "signer-keyring", "", "path to armored secret keyring to sign secconf values with")
+	flagset.StringVar(&recipients, "recipients", ".age-recipients", "path to the age recipients, age or SSH public keys")
+	flagset.StringVar(&ifVersion, "if-version", "", "only set the value if it is still at this version, use \"\" to only create new keys")
+	flagset.DurationVar(&ttl, "ttl", 0, "remove the key after this duration")
 	flagset.Parse(os.Args[2:])
 	if key == "" {
 		flagset.Usage()
@@ -99,7 +121,8 @@ func setCmd(flagset *flag.FlagSet) {
 		log.Fatal(err)
 	}
 
-	if plaintext {
+	// choosing a codec implies encryption
+	if plaintext && !isFlagSet(flagset, "codec") {
 		err := setPlain(key, backendStore, d)
 		if err != nil {
 			log.Fatal(err)
@@ -115,26 +138,220 @@ func setCmd(flagset *flag.FlagSet) {
 
 }
 func setPlain(key string, store backend.Store, d []byte) error {
-	err := store.Set(context.TODO(), key, d)
+	err := put(key, store, d)
 	return err
 
 }
 
+// put sets key to value, guarded by the -if-version flag or expiring after
+// the -ttl flag when one was given.
+func put(key string, store backend.Store, value []byte) error {
+	if ttl > 0 {
+		if isFlagSet(flagset, "if-version") {
+			return errors.New("-ttl and -if-version can't be combined")
+		}
+		ttlStore, ok := store.(backend.TTLStore)
+		if !ok {
+			return backend.ErrTTLNotSupported
+		}
+		return ttlStore.SetWithTTL(context.TODO(), key, value, ttl)
+	}
+	if !isFlagSet(flagset, "if-version") {
+		return store.Set(context.TODO(), key, value)
+	}
+	return store.CompareAndSet(context.TODO(), key, value, backend.Version(ifVersion))
+}
+
+func isFlagSet(flagset *flag.FlagSet, name string) bool {
+	set := false
+	flagset.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func setEncrypted(key, keyring string, d []byte, store backend.Store) error {
-	kr, err := os.Open(keyring)
+	var secureValue []byte
+	switch codec {
+	case "secconf", secconf.SignedName:
+		var kr []byte
+		var opts []secconf.OptionFunc
+		var err error
+		if codec == secconf.SignedName {
+			opts = append(opts, secconf.WithSignOnly())
+		} else if kr, err = ioutil.ReadFile(keyring); err != nil {
+			return err
+		}
+		if signerKeyring != "" {
+			signer, err := ioutil.ReadFile(signerKeyring)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, secconf.WithSigner(signer))
+		}
+		secureValue, err = secconf.NewCodec(kr, opts...).Encode(d)
+		if err != nil {
+			return err
+		}
+	case "age":
+		f, err := os.Open(recipients)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		ageRecipients, err := age.ParseRecipients(f)
+		if err != nil {
+			return err
+		}
+		secureValue, err = age.New(age.WithRecipients(ageRecipients...)).Encode(d)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid codec %s", codec)
+	}
+	return put(key, store, secureValue)
+}
+
+func deleteCmd(flagset *flag.FlagSet) {
+	flagset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s delete [args...] key\n", os.Args[0])
+		flagset.PrintDefaults()
+	}
+	flagset.BoolVar(&recursive, "recursive", false, "delete all keys with the given key as prefix")
+	flagset.Parse(os.Args[2:])
+	if key == "" {
+		flagset.Usage()
+		os.Exit(1)
+	}
+	backendStore, err := getBackendStore(backendName, endpoint)
 	if err != nil {
-		return err
+		log.Fatal(err)
+	}
+	if recursive {
+		err = deleteRecursive(key, backendStore)
+	} else {
+		err = backendStore.Delete(context.TODO(), key)
 	}
-	defer kr.Close()
-	secureValue, err := secconf.Encode(d, kr)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func deleteRecursive(prefix string, store backend.Store) error {
+	list, err := store.List(context.TODO(), prefix)
 	if err != nil {
 		return err
 	}
-	err = store.Set(context.TODO(), key, secureValue)
-	return err
+	for _, kv := range list {
+		if err := store.Delete(context.TODO(), kv.Key); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func getBackendStore(provider string, endpoint string) (backend.Store, error) {
+func historyCmd(flagset *flag.FlagSet) {
+	flagset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s history [args...] key\n", os.Args[0])
+		flagset.PrintDefaults()
+	}
+	flagset.StringVar(&secretKeyring, "secret-keyring", ".secring.gpg", "path to armored secret keyring")
+	flagset.StringVar(&identity, "identity", ".age-identity", "path to the age identity or SSH private key")
+	flagset.StringVar(&trusted, "trusted-keyring", "", "path to armored keyring of the trusted signers, refuses values they did not sign")
+	flagset.Parse(os.Args[2:])
+	if key == "" {
+		flagset.Usage()
+		os.Exit(1)
+	}
+	backendStore, err := getBackendStore(backendName, endpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	revisions, err := backendStore.History(context.TODO(), key, historyDepth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, rev := range revisions {
+		value := rev.Value
+		if !plaintext || trusted != "" {
+			value, err = decrypt(rev.Value, secretKeyring)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		fmt.Printf("revision %d:\n%s\n", rev.Index, value)
+	}
+}
+
+// decrypt decodes data with the age identity if it is encrypted with age,
+// and with the secconf keyring otherwise. With -trusted-keyring only
+// secconf values signed by a trusted key are accepted.
+func decrypt(data []byte, keyring string) ([]byte, error) {
+	if age.IsEncrypted(data) {
+		if trusted != "" {
+			return nil, errors.New("value is encrypted with age, which is not signed")
+		}
+		id, err := ioutil.ReadFile(identity)
+		if err != nil {
+			return nil, err
+		}
+		identities, err := age.ParseIdentities(id)
+		if err != nil {
+			return nil, err
+		}
+		return age.New(age.WithIdentities(identities...)).Decode(data)
+	}
+	var opts []secconf.OptionFunc
+	if trusted != "" {
+		tr, err := ioutil.ReadFile(trusted)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, secconf.WithTrustedSigners(tr))
+	}
+	// sign-only values need no secret key
+	var kr []byte
+	if header, _, _ := encoding.ParseHeader(data); header == nil || header.Codec != secconf.SignedName {
+		var err error
+		if kr, err = ioutil.ReadFile(keyring); err != nil {
+			return nil, err
+		}
+	}
+	return secconf.NewCodec(kr, opts...).Decode(data)
+}
+
+func rollbackCmd(flagset *flag.FlagSet) {
+	flagset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s rollback [args...] key\n", os.Args[0])
+		flagset.PrintDefaults()
+	}
+	flagset.Int64Var(&rollbackTo, "to", 0, "revision to restore, as listed by the history command")
+	flagset.Parse(os.Args[2:])
+	if key == "" || rollbackTo == 0 {
+		flagset.Usage()
+		os.Exit(1)
+	}
+	backendStore, err := getBackendStore(backendName, endpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := backendStore.Rollback(context.TODO(), key, rollbackTo); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func getBackendStore(provider string, endpoint string) (*history.Store, error) {
+	store, err := newStore(provider, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return history.New(store, history.WithDepth(historyDepth)), nil
+}
+
+func newStore(provider string, endpoint string) (backend.Store, error) {
 	if endpoint == "" {
 		switch provider {
 		case "consul":
@@ -142,18 +359,62 @@ func getBackendStore(provider string, endpoint string) (backend.Store, error) {
 		case "etcd":
 			endpoint = "http://127.0.0.1:4001"
 		case "redis":
-			endpoint = "http://127.0.0.1:6379"
+			endpoint = "redis://127.0.0.1:6379"
+		case "file":
+			endpoint = ".crypt"
+		case "vault":
+			endpoint = "http://127.0.0.1:8200"
+		case "zookeeper":
+			endpoint = "127.0.0.1:2181"
+		case "nats":
+			endpoint = "nats://127.0.0.1:4222"
+		case "s3":
+			endpoint = "http://127.0.0.1:9000/crypt"
+		case "sql":
+			endpoint = "crypt.db"
 		}
 	}
-	machines := []string{endpoint}
-	switch provider {
-	case "etcd":
-		return etcd.New(machines)
-	case "consul":
-		return consul.New(machines)
-	case "redis":
-		return redis.New(machines)
-	default:
-		return nil, errors.New("invalid backend " + provider)
+	if password == "" {
+		password = os.Getenv("CRYPT_PASSWORD")
 	}
+	return config.NewStoreWithConfig(config.Config{
+		Name:        provider,
+		Machines:    strings.Split(endpoint, ","),
+		Username:    username,
+		Password:    password,
+		DialTimeout: dialTimeout,
+		TLS: config.TLSConfig{
+			CertFile: certFile,
+			KeyFile:  keyFile,
+			CAFile:   caFile,
+		},
+		Etcd: config.EtcdConfig{
+			KeepAliveTime:    keepAliveTime,
+			KeepAliveTimeout: keepAliveTimeout,
+			Namespace:        etcdPrefix,
+		},
+		Consul: config.ConsulConfig{
+			Token:      token,
+			Datacenter: datacenter,
+			Namespace:  consulNamespace,
+			Partition:  partition,
+		},
+		Redis: config.RedisConfig{
+			DB:         db,
+			MasterName: masterName,
+			Cluster:    cluster,
+		},
+		Kubernetes: config.KubernetesConfig{
+			Namespace:  kubeNamespace,
+			ConfigMaps: configMaps,
+		},
+		Vault: config.VaultConfig{
+			Token:     token,
+			Namespace: vaultNamespace,
+			Mount:     vaultMount,
+		},
+		SQL: config.SQLConfig{
+			Driver: driver,
+		},
+	})
 }
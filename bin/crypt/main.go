@@ -5,6 +5,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
+
+	"github.com/GGXXLL/crypt/backend/history"
+	// the driver of the sql backend
+	_ "github.com/mattn/go-sqlite3"
 )
 
 var flagset = flag.NewFlagSet("crypt", flag.ExitOnError)
@@ -16,16 +21,71 @@ var (
 	keyring       string
 	endpoint      string
 	secretKeyring string
+	signerKeyring string
+	trusted       string
+	codec         string
+	recipients    string
+	identity      string
 	plaintext     bool
+	recursive     bool
+	showVersion   bool
+	ifVersion     string
+	ttl           time.Duration
+	historyDepth  int
+	rollbackTo    int64
 	machines      []string
+
+	username         string
+	password         string
+	certFile         string
+	keyFile          string
+	caFile           string
+	dialTimeout      time.Duration
+	keepAliveTime    time.Duration
+	keepAliveTimeout time.Duration
+	etcdPrefix       string
+	consulNamespace  string
+	token            string
+	datacenter       string
+	partition        string
+	db               int
+	masterName       string
+	cluster          bool
+	driver           string
+	vaultNamespace   string
+	kubeNamespace    string
+	configMaps       bool
+	vaultMount       string
 )
 
 func init() {
 	flagset.StringVar(&key, "key", "", "config key")
 	flagset.StringVar(&data, "data", "", "config data")
 	flagset.StringVar(&backendName, "backend", "etcd", "backend provider")
-	flagset.StringVar(&endpoint, "endpoint", "", "backend url")
+	flagset.StringVar(&endpoint, "endpoint", "", "backend url, comma-separated for several")
 	flagset.BoolVar(&plaintext, "plaintext", true, "skip encryption")
+	flagset.IntVar(&historyDepth, "history-depth", history.DefaultDepth, "number of previous values kept per key")
+	flagset.StringVar(&username, "username", "", "backend user name")
+	flagset.StringVar(&password, "password", "", "backend password, $CRYPT_PASSWORD if not set")
+	flagset.StringVar(&certFile, "cert-file", "", "path to the TLS client certificate")
+	flagset.StringVar(&keyFile, "key-file", "", "path to the TLS client key")
+	flagset.StringVar(&caFile, "ca-file", "", "path to the TLS CA certificates")
+	flagset.DurationVar(&dialTimeout, "dial-timeout", 0, "backend connection timeout")
+	flagset.DurationVar(&keepAliveTime, "keepalive-time", 0, "etcd keepalive ping interval")
+	flagset.DurationVar(&keepAliveTimeout, "keepalive-timeout", 0, "etcd keepalive ping timeout")
+	flagset.StringVar(&etcdPrefix, "etcd-prefix", "", "etcd key prefix")
+	flagset.StringVar(&consulNamespace, "consul-namespace", "", "consul enterprise namespace")
+	flagset.StringVar(&token, "token", "", "consul ACL token or vault token")
+	flagset.StringVar(&datacenter, "datacenter", "", "consul datacenter")
+	flagset.StringVar(&partition, "partition", "", "consul admin partition")
+	flagset.IntVar(&db, "db", 0, "redis database index")
+	flagset.StringVar(&masterName, "master-name", "", "redis sentinel master name")
+	flagset.BoolVar(&cluster, "cluster", false, "use a redis cluster client")
+	flagset.StringVar(&kubeNamespace, "kubernetes-namespace", "", "kubernetes namespace of the objects")
+	flagset.BoolVar(&configMaps, "config-maps", false, "store the kubernetes values in ConfigMaps instead of Secrets")
+	flagset.StringVar(&vaultNamespace, "vault-namespace", "", "vault enterprise namespace")
+	flagset.StringVar(&vaultMount, "vault-mount", "", "vault KV version 2 mount, secret if not set")
+	flagset.StringVar(&driver, "driver", "sqlite3", "sql database driver, only sqlite3 is built in")
 }
 
 func main() {
@@ -39,6 +99,12 @@ func main() {
 		setCmd(flagset)
 	case "get":
 		getCmd(flagset)
+	case "delete":
+		deleteCmd(flagset)
+	case "history":
+		historyCmd(flagset)
+	case "rollback":
+		rollbackCmd(flagset)
 	default:
 		help()
 	}
@@ -48,10 +114,15 @@ func help() {
 	fmt.Fprintf(os.Stderr, "usage: %s COMMAND [arg...]", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\n\n")
 	fmt.Fprintf(os.Stderr, "commands:\n")
-	fmt.Fprintf(os.Stderr, "   get   retrieve the value of a key\n")
-	fmt.Fprintf(os.Stderr, "   set   set the value of a key\n")
+	fmt.Fprintf(os.Stderr, "   get       retrieve the value of a key\n")
+	fmt.Fprintf(os.Stderr, "   set       set the value of a key\n")
+	fmt.Fprintf(os.Stderr, "   delete    remove a key\n")
+	fmt.Fprintf(os.Stderr, "   history   list the previous values of a key\n")
+	fmt.Fprintf(os.Stderr, "   rollback  restore a previous value of a key\n")
 	fmt.Fprintf(os.Stderr, "\n")
-	fmt.Fprintf(os.Stderr, "-plaintext  don't encrypt or decrypt the values before storage or retrieval\n")
+	fmt.Fprintf(os.Stderr, "-plaintext     don't encrypt or decrypt the values before storage or retrieval\n")
+	fmt.Fprintf(os.Stderr, "-show-version  print the version of the value when getting it\n")
+	fmt.Fprintf(os.Stderr, "-if-version    only set the value if it is still at the given version\n")
 
 	os.Exit(1)
 }
@@ -1,17 +1,27 @@
 package config
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/GGXXLL/crypt/backend"
 	"github.com/GGXXLL/crypt/backend/consul"
 	"github.com/GGXXLL/crypt/backend/etcd"
+	"github.com/GGXXLL/crypt/backend/file"
 	"github.com/GGXXLL/crypt/backend/firestore"
+	"github.com/GGXXLL/crypt/backend/kubernetes"
+	"github.com/GGXXLL/crypt/backend/nats"
 	"github.com/GGXXLL/crypt/backend/redis"
+	"github.com/GGXXLL/crypt/backend/s3"
+	"github.com/GGXXLL/crypt/backend/sql"
+	"github.com/GGXXLL/crypt/backend/vault"
+	"github.com/GGXXLL/crypt/backend/zookeeper"
+	"github.com/GGXXLL/crypt/encoding"
 	"github.com/GGXXLL/crypt/encoding/secconf"
+	"github.com/GGXXLL/crypt/internal"
 )
 
 type KVPair struct {
@@ -21,64 +31,336 @@ type KVPair struct {
 type KVPairs []*KVPair
 
 type configManager struct {
-	store      backend.Store
-	secret     []byte
-	withSecret bool
+	store backend.Store
+	// codec encodes and decodes values, secret decodes the values codec
+	// does not detect and encodes if there is no codec.
+	codec  encoding.Codec
+	secret encoding.Codec
+	// secretKey and secconf configure the secret codec, which is built
+	// once all options are applied.
+	secretKey []byte
+	secconf   []secconf.OptionFunc
+	// signed and verified are set by the options which only secconf
+	// supports.
+	signed   bool
+	verified bool
 }
 
 type Config struct {
-	Name          string
-	Machines      []string
+	Name     string
+	Machines []string
+	// Secret is not used by NewConfigManager, pass it to WithSecretKey to
+	// encode values with secconf.
 	Secret        []byte
 	WatchInterval time.Duration
+
+	// Username and Password authenticate with the backend.
+	Username string
+	Password string
+	// DialTimeout limits how long connecting to the backend may take.
+	DialTimeout time.Duration
+	// TLS configures encrypted connections to the backend.
+	TLS TLSConfig
+	// Etcd holds the options only the etcd backend supports.
+	Etcd EtcdConfig
+	// Consul holds the options only the consul backend supports.
+	Consul ConsulConfig
+	// Redis holds the options only the redis backend supports.
+	Redis RedisConfig
+	// SQL holds the options only the sql backend supports.
+	SQL SQLConfig
+	// Kubernetes holds the options only the kubernetes backend supports.
+	Kubernetes KubernetesConfig
+	// Vault holds the options only the vault backend supports. Username
+	// and Password are the AppRole role and secret id.
+	Vault VaultConfig
+}
+
+// TLSConfig names the PEM files of a TLS connection. TLS is not used if
+// none is set and InsecureSkipVerify is false.
+type TLSConfig struct {
+	CertFile           string
+	KeyFile            string
+	CAFile             string
+	InsecureSkipVerify bool
+}
+
+type EtcdConfig struct {
+	// KeepAliveTime and KeepAliveTimeout enable keepalive pings.
+	KeepAliveTime    time.Duration
+	KeepAliveTimeout time.Duration
+	// Namespace prefixes every key.
+	Namespace string
+}
+
+type ConsulConfig struct {
+	// Token is the ACL token, CONSUL_HTTP_TOKEN if empty.
+	Token      string
+	Datacenter string
+	// Namespace and Partition select the Consul Enterprise namespace and
+	// admin partition.
+	Namespace string
+	Partition string
+}
+
+type RedisConfig struct {
+	// DB is the index of the database.
+	DB int
+	// MasterName connects through the sentinels given as machines to the
+	// master monitored under this name.
+	MasterName string
+	// Cluster uses a cluster client even for a single machine.
+	Cluster bool
+	// KeyspaceEvents makes watches subscribe to keyspace notifications
+	// instead of polling. EnableKeyspaceEvents turns the notifications on
+	// with CONFIG SET if the server has them off.
+	KeyspaceEvents       bool
+	EnableKeyspaceEvents bool
+}
+
+type KubernetesConfig struct {
+	// Namespace of the objects, the one of the kubeconfig context or the
+	// pod if empty.
+	Namespace string
+	// ConfigMaps stores the values in ConfigMaps instead of Secrets.
+	ConfigMaps bool
+}
+
+type VaultConfig struct {
+	// Token authenticates requests if no AppRole is set, VAULT_TOKEN if
+	// both are empty.
+	Token string
+	// Namespace is the vault enterprise namespace.
+	Namespace string
+	// Mount is the path of the KV version 2 engine, "secret" if empty.
+	Mount string
+}
+
+type SQLConfig struct {
+	// Driver is the database/sql driver, sqlite3 if empty. It has to be
+	// registered by importing it.
+	Driver string
 }
 
 // Manager A ConfigManager retrieves and decrypts configuration from a key/value store.
 type Manager interface {
 	Get(ctx context.Context, key string) ([]byte, error)
 	Set(ctx context.Context, key string, value []byte) error
+	SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Lease(ctx context.Context, ttl time.Duration) (backend.Lease, error)
+	GetWithVersion(ctx context.Context, key string) ([]byte, backend.Version, error)
+	CompareAndSet(ctx context.Context, key string, value []byte, expected backend.Version) error
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) (KVPairs, error)
 	Watch(ctx context.Context, key string) <-chan *Response
+	WatchPrefix(ctx context.Context, prefix string) <-chan *Event
 }
 
 type OptionFunc func(c *configManager)
 
+// WithSecretKey encodes values with secconf using the armored keyring
+// secret.
 func WithSecretKey(secret []byte) OptionFunc {
 	return func(c *configManager) {
-		c.secret = secret
-		c.withSecret = true
+		c.secretKey = secret
 	}
 }
 
-func NewConfigManager(cfg Config) (Manager, error) {
-	if cfg.WatchInterval == 0 {
-		cfg.WatchInterval = 10 * time.Second
+// WithSigner signs values encoded with secconf using the first private key
+// of the armored keyring signer. It can't be combined with WithCodec.
+func WithSigner(signer []byte) OptionFunc {
+	return func(c *configManager) {
+		c.secconf = append(c.secconf, secconf.WithSigner(signer))
+		c.signed = true
 	}
-	store, err := NewStore(cfg.Name, cfg.Machines, cfg.WatchInterval)
-	if err != nil {
-		return nil, err
+}
+
+// WithTrustedSigners makes Get fail for secconf values which are not
+// signed by a key of the armored keyring trusted. Plain and unsigned
+// values are refused as well. It can't be combined with WithCodec.
+func WithTrustedSigners(trusted []byte) OptionFunc {
+	return func(c *configManager) {
+		c.secconf = append(c.secconf, secconf.WithTrustedSigners(trusted))
+		c.verified = true
 	}
-	m := &configManager{
-		store:      store,
-		secret:     cfg.Secret,
-		withSecret: false,
+}
+
+// WithSignOnly signs values with the key of WithSigner without encrypting
+// them, for configuration which is not secret.
+func WithSignOnly() OptionFunc {
+	return func(c *configManager) {
+		c.secconf = append(c.secconf, secconf.WithSignOnly())
+		c.signed = true
 	}
+}
 
-	return m, nil
+// WithCodec encodes values with codecs instead of secconf. Several codecs
+// are chained, so WithCodec(encoding.Gzip{}, encrypt) compresses values
+// before they are encrypted. If a secret key is set as well and the codec
+// is an encoding.Detector, values it does not recognize are decoded with
+// secconf, so existing values stay readable.
+func WithCodec(codecs ...encoding.Codec) OptionFunc {
+	return func(c *configManager) {
+		c.codec = encoding.Chain(codecs...)
+	}
+}
+
+// NewConfigManager creates the backend of cfg and applies opts. cfg.Secret
+// is not used, values are only encoded with secconf if WithSecretKey is
+// passed.
+func NewConfigManager(cfg Config, opts ...OptionFunc) (Manager, error) {
+	store, err := NewStoreWithConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewConfigManagerWithStore(store, opts...)
 }
 
 func NewStore(name string, machines []string, watchInterval time.Duration) (backend.Store, error) {
-	switch name {
+	return NewStoreWithConfig(Config{Name: name, Machines: machines, WatchInterval: watchInterval})
+}
+
+// NewStoreWithConfig creates the backend cfg.Name with the connection
+// options of cfg. Options a backend does not support are ignored.
+func NewStoreWithConfig(cfg Config) (backend.Store, error) {
+	if cfg.WatchInterval == 0 {
+		cfg.WatchInterval = 10 * time.Second
+	}
+	tlsConfig, err := internal.TLSConfig(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.CAFile, cfg.TLS.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	machines, watchInterval := cfg.Machines, cfg.WatchInterval
+	switch cfg.Name {
 	case "etcd":
-		return etcd.New(machines)
+		return etcd.New(machines, etcdOptions(cfg, tlsConfig)...)
 	case "consul":
-		return consul.New(machines, consul.WithWatchInterval(watchInterval))
+		return consul.New(machines, consulOptions(cfg, tlsConfig)...)
 	case "redis":
-		return redis.New(machines, redis.WithWatchInterval(watchInterval))
+		return redis.New(machines, redisOptions(cfg, tlsConfig)...)
 	case "firestore":
 		return firestore.New(machines, firestore.WithWatchInterval(watchInterval))
+	case "file":
+		return file.New(machines, file.WithWatchInterval(watchInterval))
+	case "vault":
+		return vault.New(machines, vaultOptions(cfg, tlsConfig)...)
+	case "zookeeper":
+		return zookeeper.New(machines, zookeeper.WithWatchInterval(watchInterval))
+	case "nats":
+		return nats.New(machines)
+	case "kubernetes":
+		return kubernetes.New(machines, kubernetesOptions(cfg)...)
+	case "s3":
+		return s3.New(machines, s3.WithWatchInterval(watchInterval))
+	case "sql":
+		opts := []sql.OptionFunc{sql.WithWatchInterval(watchInterval)}
+		if cfg.SQL.Driver != "" {
+			opts = append(opts, sql.WithDriver(cfg.SQL.Driver))
+		}
+		return sql.New(machines, opts...)
 	default:
-		return nil, errors.New("invalid backend " + name)
+		return nil, errors.New("invalid backend " + cfg.Name)
+	}
+}
+
+func etcdOptions(cfg Config, tlsConfig *tls.Config) []etcd.OptionFunc {
+	var opts []etcd.OptionFunc
+	if tlsConfig != nil {
+		opts = append(opts, etcd.WithTLS(tlsConfig))
+	}
+	if cfg.Username != "" {
+		opts = append(opts, etcd.WithAuth(cfg.Username, cfg.Password))
+	}
+	if cfg.DialTimeout > 0 {
+		opts = append(opts, etcd.WithDialTimeout(cfg.DialTimeout))
+	}
+	if cfg.Etcd.KeepAliveTime > 0 {
+		opts = append(opts, etcd.WithKeepAlive(cfg.Etcd.KeepAliveTime, cfg.Etcd.KeepAliveTimeout))
+	}
+	if cfg.Etcd.Namespace != "" {
+		opts = append(opts, etcd.WithNamespace(cfg.Etcd.Namespace))
+	}
+	return opts
+}
+
+func kubernetesOptions(cfg Config) []kubernetes.OptionFunc {
+	var opts []kubernetes.OptionFunc
+	if cfg.Kubernetes.Namespace != "" {
+		opts = append(opts, kubernetes.WithNamespace(cfg.Kubernetes.Namespace))
+	}
+	if cfg.Kubernetes.ConfigMaps {
+		opts = append(opts, kubernetes.WithConfigMaps())
+	}
+	return opts
+}
+
+func vaultOptions(cfg Config, tlsConfig *tls.Config) []vault.OptionFunc {
+	opts := []vault.OptionFunc{vault.WithWatchInterval(cfg.WatchInterval)}
+	if tlsConfig != nil {
+		opts = append(opts, vault.WithTLS(tlsConfig))
+	}
+	if cfg.DialTimeout > 0 {
+		opts = append(opts, vault.WithDialTimeout(cfg.DialTimeout))
+	}
+	if cfg.Username != "" {
+		opts = append(opts, vault.WithAppRole(cfg.Username, cfg.Password))
+	}
+	if cfg.Vault.Token != "" {
+		opts = append(opts, vault.WithToken(cfg.Vault.Token))
+	}
+	if cfg.Vault.Namespace != "" {
+		opts = append(opts, vault.WithNamespace(cfg.Vault.Namespace))
 	}
+	if cfg.Vault.Mount != "" {
+		opts = append(opts, vault.WithMount(cfg.Vault.Mount))
+	}
+	return opts
+}
+
+func consulOptions(cfg Config, tlsConfig *tls.Config) []consul.OptionFunc {
+	opts := []consul.OptionFunc{consul.WithWatchInterval(cfg.WatchInterval)}
+	if tlsConfig != nil {
+		opts = append(opts, consul.WithTLS(tlsConfig))
+	}
+	if cfg.Consul.Token != "" {
+		opts = append(opts, consul.WithToken(cfg.Consul.Token))
+	}
+	if cfg.Consul.Datacenter != "" {
+		opts = append(opts, consul.WithDatacenter(cfg.Consul.Datacenter))
+	}
+	if cfg.Consul.Namespace != "" {
+		opts = append(opts, consul.WithNamespace(cfg.Consul.Namespace))
+	}
+	if cfg.Consul.Partition != "" {
+		opts = append(opts, consul.WithPartition(cfg.Consul.Partition))
+	}
+	return opts
+}
+
+func redisOptions(cfg Config, tlsConfig *tls.Config) []redis.OptionFunc {
+	opts := []redis.OptionFunc{redis.WithWatchInterval(cfg.WatchInterval)}
+	if tlsConfig != nil {
+		opts = append(opts, redis.WithTLS(tlsConfig))
+	}
+	if cfg.Username != "" || cfg.Password != "" {
+		opts = append(opts, redis.WithAuth(cfg.Username, cfg.Password))
+	}
+	if cfg.DialTimeout > 0 {
+		opts = append(opts, redis.WithDialTimeout(cfg.DialTimeout))
+	}
+	if cfg.Redis.DB != 0 {
+		opts = append(opts, redis.WithDB(cfg.Redis.DB))
+	}
+	if cfg.Redis.MasterName != "" {
+		opts = append(opts, redis.WithMasterName(cfg.Redis.MasterName))
+	}
+	if cfg.Redis.Cluster {
+		opts = append(opts, redis.WithCluster())
+	}
+	if cfg.Redis.KeyspaceEvents || cfg.Redis.EnableKeyspaceEvents {
+		opts = append(opts, redis.WithKeyspaceEvents(cfg.Redis.EnableKeyspaceEvents))
+	}
+	return opts
 }
 
 func NewConfigManagerWithStore(store backend.Store, opts ...OptionFunc) (Manager, error) {
@@ -86,33 +368,166 @@ func NewConfigManagerWithStore(store backend.Store, opts ...OptionFunc) (Manager
 	for _, opt := range opts {
 		opt(m)
 	}
+	// values of the codec would be stored unsigned and returned unverified.
+	if m.codec != nil && m.signed {
+		return nil, errors.New("WithCodec can't be combined with WithSigner or WithSignOnly")
+	}
+	if m.codec != nil && m.verified {
+		return nil, errors.New("WithCodec can't be combined with WithTrustedSigners")
+	}
+	if len(m.secretKey) > 0 || len(m.secconf) > 0 {
+		m.secret = secconf.NewCodec(m.secretKey, m.secconf...)
+	}
 	return m, nil
 }
 
-// Get retrieves and decodes a secconf value stored at key.
+// Get retrieves and decodes the value stored at key.
 func (c *configManager) Get(ctx context.Context, key string) ([]byte, error) {
 	value, err := c.store.Get(ctx, key)
 	if err != nil {
 		return nil, err
 	}
-	if c.withSecret {
-		return secconf.Decode(value, bytes.NewBuffer(c.secret))
+	return c.decode(value)
+}
+
+// encode encodes value with the codec, or with secconf if a secret key is
+// set.
+func (c *configManager) encode(value []byte) ([]byte, error) {
+	switch {
+	case c.codec != nil:
+		return c.codec.Encode(value)
+	case c.secret != nil:
+		return c.secret.Encode(value)
+	default:
+		return value, nil
+	}
+}
+
+// decode detects whether value was encoded with the codec or with secconf
+// and decodes it. Values with an encoding.Header are never returned
+// undecoded.
+func (c *configManager) decode(value []byte) ([]byte, error) {
+	header, _, err := encoding.ParseHeader(value)
+	if err != nil {
+		return nil, err
+	}
+	if c.codec != nil {
+		detector, ok := c.codec.(encoding.Detector)
+		if !ok || detector.Detect(value) || (c.secret == nil && header == nil) {
+			return c.codec.Decode(value)
+		}
+	}
+	if c.secret != nil {
+		return c.secret.Decode(value)
+	}
+	if header != nil {
+		return nil, fmt.Errorf("value is encoded with %s, which is not configured", header.Codec)
 	}
 	return value, nil
 }
 
 // Set will put a key/value into the data store
-// and encode it with secconf
+// and encode it with the codec
 func (c *configManager) Set(ctx context.Context, key string, value []byte) error {
-	if c.withSecret {
-		encodedValue, err := secconf.Encode(value, bytes.NewBuffer(c.secret))
+	value, err := c.encode(value)
+	if err != nil {
+		return err
+	}
+	return c.store.Set(ctx, key, value)
+}
+
+// SetWithTTL encodes value like Set and puts it into the data
+// store, which removes it after ttl. It returns backend.ErrTTLNotSupported
+// if the store can't expire keys.
+func (c *configManager) SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	store, ok := c.store.(backend.TTLStore)
+	if !ok {
+		return backend.ErrTTLNotSupported
+	}
+	value, err := c.encode(value)
+	if err != nil {
+		return err
+	}
+	return store.SetWithTTL(ctx, key, value, ttl)
+}
+
+// Lease grants a lease of ttl which is kept alive until ctx is done. Values
+// set through the lease are encoded like Set and removed with
+// the lease. It returns backend.ErrLeaseNotSupported if the store has no
+// leases.
+func (c *configManager) Lease(ctx context.Context, ttl time.Duration) (backend.Lease, error) {
+	store, ok := c.store.(backend.LeaseStore)
+	if !ok {
+		return nil, backend.ErrLeaseNotSupported
+	}
+	lease, err := store.Lease(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &configLease{Lease: lease, manager: c}, nil
+}
+
+type configLease struct {
+	backend.Lease
+	manager *configManager
+}
+
+// Set encodes value and puts it into the data store attached
+// to the lease.
+func (l *configLease) Set(ctx context.Context, key string, value []byte) error {
+	value, err := l.manager.encode(value)
+	if err != nil {
+		return err
+	}
+	return l.Lease.Set(ctx, key, value)
+}
+
+// GetWithVersion retrieves and decodes the value stored at key
+// together with its version in the data store.
+func (c *configManager) GetWithVersion(ctx context.Context, key string) ([]byte, backend.Version, error) {
+	value, version, err := c.store.GetWithVersion(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	value, err = c.decode(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return value, version, nil
+}
+
+// CompareAndSet encodes value and puts it into the data store
+// only if key is still at version expected. It returns
+// backend.ErrVersionMismatch otherwise.
+func (c *configManager) CompareAndSet(ctx context.Context, key string, value []byte, expected backend.Version) error {
+	value, err := c.encode(value)
+	if err != nil {
+		return err
+	}
+	return c.store.CompareAndSet(ctx, key, value, expected)
+}
+
+// Delete removes key from the data store.
+func (c *configManager) Delete(ctx context.Context, key string) error {
+	return c.store.Delete(ctx, key)
+}
+
+// List retrieves and decodes all values stored under prefix.
+func (c *configManager) List(ctx context.Context, prefix string) (KVPairs, error) {
+	list, err := c.store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	retList := make(KVPairs, len(list))
+	for i, kv := range list {
+		retList[i] = &KVPair{KVPair: *kv}
+		value, err := c.decode(kv.Value)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return c.store.Set(ctx, key, encodedValue)
+		retList[i].Value = value
 	}
-
-	return c.store.Set(ctx, key, value)
+	return retList, nil
 }
 
 type Response struct {
@@ -131,12 +546,8 @@ func (c *configManager) Watch(ctx context.Context, key string) <-chan *Response
 					resp <- &Response{nil, r.Error}
 					continue
 				}
-				if c.withSecret {
-					value, err := secconf.Decode(r.Value, bytes.NewBuffer(c.secret))
-					resp <- &Response{value, err}
-					continue
-				}
-				resp <- &Response{r.Value, r.Error}
+				value, err := c.decode(r.Value)
+				resp <- &Response{value, err}
 			case <-ctx.Done():
 				resp <- &Response{Error: ctx.Err()}
 				return
@@ -146,3 +557,35 @@ func (c *configManager) Watch(ctx context.Context, key string) <-chan *Response
 	}()
 	return resp
 }
+
+// Event is a change of a single key reported by WatchPrefix.
+type Event struct {
+	backend.Event
+}
+
+// WatchPrefix monitors all keys under prefix and decodes the values of
+// put events.
+func (c *configManager) WatchPrefix(ctx context.Context, prefix string) <-chan *Event {
+	resp := make(chan *Event, 0)
+	backendResp := c.store.WatchPrefix(ctx, prefix)
+	go func() {
+		for {
+			select {
+			case e, ok := <-backendResp:
+				if !ok {
+					backendResp = nil
+					continue
+				}
+				event := &Event{Event: *e}
+				if e.Error == nil && e.Type == backend.EventPut {
+					event.Value, event.Error = c.decode(e.Value)
+				}
+				resp <- event
+			case <-ctx.Done():
+				resp <- &Event{backend.Event{Error: ctx.Err()}}
+				return
+			}
+		}
+	}()
+	return resp
+}
@@ -3,8 +3,15 @@ package config
 import (
 	"context"
 	"testing"
+	"time"
 
+	filippoage "filippo.io/age"
+	"github.com/GGXXLL/crypt/backend"
+	"github.com/GGXXLL/crypt/backend/file"
 	"github.com/GGXXLL/crypt/backend/mock"
+	"github.com/GGXXLL/crypt/encoding"
+	"github.com/GGXXLL/crypt/encoding/age"
+	"github.com/GGXXLL/crypt/encoding/secconf"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -165,3 +172,321 @@ func TestClient(t *testing.T) {
 	r = <-resp
 	assert.Error(t, r.Error)
 }
+
+func TestList(t *testing.T) {
+	store, err := mock.New([]string{})
+	assert.NoError(t, err)
+
+	cm, err := NewConfigManagerWithStore(store, WithSecretKey([]byte(pubring)))
+	assert.NoError(t, err)
+
+	cmForGet, err := NewConfigManagerWithStore(store, WithSecretKey([]byte(secring)))
+	assert.NoError(t, err)
+
+	err = cm.Set(context.TODO(), "crypt_list/a", []byte("a"))
+	assert.NoError(t, err)
+	err = cm.Set(context.TODO(), "crypt_list/b", []byte("b"))
+	assert.NoError(t, err)
+
+	list, err := cmForGet.List(context.TODO(), "crypt_list/")
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+	assert.Equal(t, "crypt_list/a", list[0].Key)
+	assert.Equal(t, []byte("a"), list[0].Value)
+	assert.Equal(t, "crypt_list/b", list[1].Key)
+	assert.Equal(t, []byte("b"), list[1].Value)
+}
+
+func TestDelete(t *testing.T) {
+	store, err := mock.New([]string{})
+	assert.NoError(t, err)
+
+	cm, err := NewConfigManagerWithStore(store)
+	assert.NoError(t, err)
+
+	err = cm.Set(context.TODO(), "crypt_delete", []byte("test"))
+	assert.NoError(t, err)
+
+	err = cm.Delete(context.TODO(), "crypt_delete")
+	assert.NoError(t, err)
+
+	_, err = cm.Get(context.TODO(), "crypt_delete")
+	assert.Error(t, err)
+}
+
+func TestWatchPrefix(t *testing.T) {
+	store, err := mock.New([]string{})
+	assert.NoError(t, err)
+
+	cm, err := NewConfigManagerWithStore(store, WithSecretKey([]byte(pubring)))
+	assert.NoError(t, err)
+
+	cmForGet, err := NewConfigManagerWithStore(store, WithSecretKey([]byte(secring)))
+	assert.NoError(t, err)
+
+	err = cm.Set(context.TODO(), "crypt_watch/a", []byte("a"))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := cmForGet.WatchPrefix(ctx, "crypt_watch/")
+
+	err = cm.Set(context.TODO(), "crypt_watch/b", []byte("b"))
+	assert.NoError(t, err)
+	err = cm.Delete(context.TODO(), "crypt_watch/a")
+	assert.NoError(t, err)
+
+	events := map[string]*Event{}
+	for len(events) < 2 {
+		e := <-resp
+		assert.NoError(t, e.Error)
+		events[e.Key] = e
+	}
+	assert.Equal(t, backend.EventPut, events["crypt_watch/b"].Type)
+	assert.Equal(t, []byte("b"), events["crypt_watch/b"].Value)
+	assert.Equal(t, backend.EventDelete, events["crypt_watch/a"].Type)
+
+	cancel()
+	e := <-resp
+	assert.Error(t, e.Error)
+}
+
+func TestCompareAndSet(t *testing.T) {
+	store, err := mock.New([]string{})
+	assert.NoError(t, err)
+
+	cm, err := NewConfigManagerWithStore(store, WithSecretKey([]byte(pubring)))
+	assert.NoError(t, err)
+
+	cmForGet, err := NewConfigManagerWithStore(store, WithSecretKey([]byte(secring)))
+	assert.NoError(t, err)
+
+	err = cm.CompareAndSet(context.TODO(), "crypt_cas", []byte("test"), "")
+	assert.NoError(t, err)
+	err = cm.CompareAndSet(context.TODO(), "crypt_cas", []byte("test"), "")
+	assert.Equal(t, backend.ErrVersionMismatch, err)
+
+	val, version, err := cmForGet.GetWithVersion(context.TODO(), "crypt_cas")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+
+	err = cm.CompareAndSet(context.TODO(), "crypt_cas", []byte("update"), version)
+	assert.NoError(t, err)
+	err = cm.CompareAndSet(context.TODO(), "crypt_cas", []byte("stale"), version)
+	assert.Equal(t, backend.ErrVersionMismatch, err)
+
+	val, err = cmForGet.Get(context.TODO(), "crypt_cas")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("update"), val)
+}
+
+func TestSetWithTTL(t *testing.T) {
+	store, err := mock.New([]string{})
+	assert.NoError(t, err)
+
+	cm, err := NewConfigManagerWithStore(store, WithSecretKey([]byte(pubring)))
+	assert.NoError(t, err)
+
+	cmForGet, err := NewConfigManagerWithStore(store, WithSecretKey([]byte(secring)))
+	assert.NoError(t, err)
+
+	err = cm.SetWithTTL(context.TODO(), "crypt_ttl", []byte("test"), 50*time.Millisecond)
+	assert.NoError(t, err)
+
+	val, err := cmForGet.Get(context.TODO(), "crypt_ttl")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = cmForGet.Get(context.TODO(), "crypt_ttl")
+	assert.Error(t, err)
+
+	fileStore, err := file.New([]string{t.TempDir()})
+	assert.NoError(t, err)
+	cm, err = NewConfigManagerWithStore(fileStore)
+	assert.NoError(t, err)
+	err = cm.SetWithTTL(context.TODO(), "crypt_ttl", []byte("test"), time.Minute)
+	assert.Equal(t, backend.ErrTTLNotSupported, err)
+}
+
+func TestLease(t *testing.T) {
+	store, err := mock.New([]string{})
+	assert.NoError(t, err)
+
+	cm, err := NewConfigManagerWithStore(store, WithSecretKey([]byte(pubring)))
+	assert.NoError(t, err)
+
+	cmForGet, err := NewConfigManagerWithStore(store, WithSecretKey([]byte(secring)))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lease, err := cm.Lease(ctx, 10*time.Second)
+	assert.NoError(t, err)
+	err = lease.Set(context.TODO(), "crypt_lease", []byte("canary"))
+	assert.NoError(t, err)
+
+	val, err := cmForGet.Get(context.TODO(), "crypt_lease")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("canary"), val)
+
+	// canceling the context revokes the lease and removes its keys.
+	cancel()
+	<-lease.Done()
+	_, err = cmForGet.Get(context.TODO(), "crypt_lease")
+	assert.Error(t, err)
+
+	fileStore, err := file.New([]string{t.TempDir()})
+	assert.NoError(t, err)
+	cm, err = NewConfigManagerWithStore(fileStore)
+	assert.NoError(t, err)
+	_, err = cm.Lease(context.TODO(), time.Minute)
+	assert.Equal(t, backend.ErrLeaseNotSupported, err)
+}
+
+func TestWithCodec(t *testing.T) {
+	store, err := mock.New([]string{})
+	assert.NoError(t, err)
+
+	identity, err := filippoage.GenerateX25519Identity()
+	assert.NoError(t, err)
+	codec := age.New(age.WithRecipients(identity.Recipient()), age.WithIdentities(identity))
+
+	cmLegacy, err := NewConfigManagerWithStore(store, WithSecretKey([]byte(pubring)))
+	assert.NoError(t, err)
+	cm, err := NewConfigManagerWithStore(store, WithSecretKey([]byte(secring)), WithCodec(codec))
+	assert.NoError(t, err)
+
+	err = cmLegacy.Set(context.TODO(), "crypt_codec/legacy", []byte("legacy"))
+	assert.NoError(t, err)
+	err = cm.Set(context.TODO(), "crypt_codec/age", []byte("age"))
+	assert.NoError(t, err)
+
+	raw, err := store.Get(context.TODO(), "crypt_codec/age")
+	assert.NoError(t, err)
+	assert.True(t, age.IsEncrypted(raw))
+
+	// values of both codecs are decoded.
+	list, err := cm.List(context.TODO(), "crypt_codec/")
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+	assert.Equal(t, []byte("age"), list[0].Value)
+	assert.Equal(t, []byte("legacy"), list[1].Value)
+
+	// chained codecs compress before encrypting.
+	cm, err = NewConfigManagerWithStore(store, WithCodec(encoding.Gzip{}, codec))
+	assert.NoError(t, err)
+	err = cm.Set(context.TODO(), "crypt_codec/chain", []byte("chain"))
+	assert.NoError(t, err)
+	raw, err = store.Get(context.TODO(), "crypt_codec/chain")
+	assert.NoError(t, err)
+	raw, err = codec.Decode(raw)
+	assert.NoError(t, err)
+	assert.True(t, encoding.Gzip{}.Detect(raw))
+	val, err := cm.Get(context.TODO(), "crypt_codec/chain")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("chain"), val)
+}
+
+func TestSigned(t *testing.T) {
+	store, err := mock.New([]string{})
+	assert.NoError(t, err)
+
+	cm, err := NewConfigManagerWithStore(store, WithSecretKey([]byte(pubring)), WithSigner([]byte(secring)))
+	assert.NoError(t, err)
+	cmForGet, err := NewConfigManagerWithStore(store, WithSecretKey([]byte(secring)), WithTrustedSigners([]byte(pubring)))
+	assert.NoError(t, err)
+
+	err = cm.Set(context.TODO(), "crypt_signed", []byte("test"))
+	assert.NoError(t, err)
+	val, err := cmForGet.Get(context.TODO(), "crypt_signed")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+
+	// unsigned and plain values are refused.
+	unsigned, err := NewConfigManagerWithStore(store, WithSecretKey([]byte(pubring)))
+	assert.NoError(t, err)
+	err = unsigned.Set(context.TODO(), "crypt_unsigned", []byte("test"))
+	assert.NoError(t, err)
+	_, err = cmForGet.Get(context.TODO(), "crypt_unsigned")
+	assert.Error(t, err)
+
+	err = store.Set(context.TODO(), "crypt_plain", []byte("test"))
+	assert.NoError(t, err)
+	_, err = cmForGet.Get(context.TODO(), "crypt_plain")
+	assert.Error(t, err)
+}
+
+func TestSignOnly(t *testing.T) {
+	store, err := mock.New([]string{})
+	assert.NoError(t, err)
+
+	cm, err := NewConfigManagerWithStore(store, WithSigner([]byte(secring)), WithSignOnly())
+	assert.NoError(t, err)
+	cmForGet, err := NewConfigManagerWithStore(store, WithTrustedSigners([]byte(pubring)))
+	assert.NoError(t, err)
+
+	err = cm.Set(context.TODO(), "crypt_signed", []byte("test"))
+	assert.NoError(t, err)
+	raw, err := store.Get(context.TODO(), "crypt_signed")
+	assert.NoError(t, err)
+	header, _, err := encoding.ParseHeader(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, secconf.SignedName, header.Codec)
+
+	val, err := cmForGet.Get(context.TODO(), "crypt_signed")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+
+	// values of other codecs would be neither signed nor verified.
+	_, err = NewConfigManagerWithStore(store, WithSigner([]byte(secring)), WithCodec(encoding.Gzip{}))
+	assert.Error(t, err)
+	_, err = NewConfigManagerWithStore(store, WithTrustedSigners([]byte(pubring)), WithCodec(encoding.Identity{}))
+	assert.Error(t, err)
+}
+
+func TestNewConfigManager(t *testing.T) {
+	dir := t.TempDir()
+	// cfg.Secret is not used.
+	cm, err := NewConfigManager(Config{Name: "file", Machines: []string{dir}, Secret: []byte(pubring)})
+	assert.NoError(t, err)
+	err = cm.Set(context.TODO(), "crypt_plain", []byte("test"))
+	assert.NoError(t, err)
+	val, err := cm.Get(context.TODO(), "crypt_plain")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), val)
+
+	cm, err = NewConfigManager(Config{Name: "file", Machines: []string{dir}}, WithSecretKey([]byte(pubring)))
+	assert.NoError(t, err)
+	err = cm.Set(context.TODO(), "crypt_secret", []byte("test"))
+	assert.NoError(t, err)
+
+	store, err := file.New([]string{dir})
+	assert.NoError(t, err)
+	raw, err := store.Get(context.TODO(), "crypt_secret")
+	assert.NoError(t, err)
+	assert.True(t, secconf.NewCodec(nil).Detect(raw))
+
+	// encoded values are not returned undecoded.
+	cm, err = NewConfigManager(Config{Name: "file", Machines: []string{dir}})
+	assert.NoError(t, err)
+	_, err = cm.Get(context.TODO(), "crypt_secret")
+	assert.Error(t, err)
+
+	cm, err = NewConfigManager(Config{Name: "file", Machines: []string{dir}}, WithCodec(encoding.Identity{}))
+	assert.NoError(t, err)
+	val, err = cm.Get(context.TODO(), "crypt_secret")
+	assert.NoError(t, err)
+	assert.Equal(t, raw, val)
+}
+
+func TestNewStoreWithConfig(t *testing.T) {
+	store, err := NewStoreWithConfig(Config{Name: "file", Machines: []string{t.TempDir()}})
+	assert.NoError(t, err)
+	assert.NotNil(t, store)
+
+	_, err = NewStoreWithConfig(Config{Name: "etcd", TLS: TLSConfig{CAFile: "testdata/missing.pem"}})
+	assert.Error(t, err)
+
+	_, err = NewStoreWithConfig(Config{Name: "unknown"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,154 @@
+// Package age implements a codec which encrypts values with age
+// (https://age-encryption.org) for X25519 and SSH recipients. Values are
+// stored ASCII-armored:
+//
+//	armor(age(data))
+package age
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+)
+
+// binaryHeader starts the age format without armor.
+const binaryHeader = "age-encryption.org/v1\n"
+
+// Codec encrypts values for its recipients and decrypts them with its
+// identities.
+type Codec struct {
+	recipients []age.Recipient
+	identities []age.Identity
+}
+
+type OptionFunc func(c *Codec)
+
+// WithRecipients sets the recipients values are encrypted for.
+func WithRecipients(recipients ...age.Recipient) OptionFunc {
+	return func(c *Codec) {
+		c.recipients = append(c.recipients, recipients...)
+	}
+}
+
+// WithIdentities sets the identities values are decrypted with.
+func WithIdentities(identities ...age.Identity) OptionFunc {
+	return func(c *Codec) {
+		c.identities = append(c.identities, identities...)
+	}
+}
+
+func New(opts ...OptionFunc) *Codec {
+	c := &Codec{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Encode encrypts data for all recipients of the codec.
+func (c *Codec) Encode(data []byte) ([]byte, error) {
+	if len(c.recipients) == 0 {
+		return nil, errors.New("age: no recipients to encrypt for")
+	}
+	buffer := new(bytes.Buffer)
+	armorWriter := armor.NewWriter(buffer)
+	ageWriter, err := age.Encrypt(armorWriter, c.recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ageWriter.Write(data); err != nil {
+		return nil, err
+	}
+	if err := ageWriter.Close(); err != nil {
+		return nil, err
+	}
+	if err := armorWriter.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Decode decrypts data with the identities of the codec. Both armored and
+// binary age files are accepted.
+func (c *Codec) Decode(data []byte) ([]byte, error) {
+	if len(c.identities) == 0 {
+		return nil, errors.New("age: no identities to decrypt with")
+	}
+	var src io.Reader = bytes.NewReader(data)
+	if isArmored(data) {
+		src = armor.NewReader(bytes.NewReader(bytes.TrimSpace(data)))
+	}
+	r, err := age.Decrypt(src, c.identities...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// Detect reports whether data is encrypted with age.
+func (c *Codec) Detect(data []byte) bool {
+	return IsEncrypted(data)
+}
+
+// IsEncrypted reports whether data is an armored or binary age file.
+func IsEncrypted(data []byte) bool {
+	return isArmored(data) || bytes.HasPrefix(data, []byte(binaryHeader))
+}
+
+func isArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header))
+}
+
+// ParseRecipients parses a recipients file with one recipient per line,
+// either an age public key ("age1...") or an SSH public key ("ssh-ed25519
+// ..." or "ssh-rsa ..."). Empty lines and lines starting with # are
+// ignored.
+func ParseRecipients(r io.Reader) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var recipient age.Recipient
+		var err error
+		if strings.HasPrefix(line, "ssh-") {
+			recipient, err = agessh.ParseRecipient(line)
+		} else {
+			recipient, err = age.ParseX25519Recipient(line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("age: invalid recipient at line %d: %v", n, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("age: no recipients found")
+	}
+	return recipients, nil
+}
+
+// ParseIdentities parses an age identity file ("AGE-SECRET-KEY-1...") or
+// an unencrypted SSH private key in PEM format.
+func ParseIdentities(data []byte) ([]age.Identity, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		identity, err := agessh.ParseIdentity(data)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Identity{identity}, nil
+	}
+	return age.ParseIdentities(bytes.NewReader(data))
+}
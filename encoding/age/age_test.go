@@ -0,0 +1,54 @@
+package age
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCodec(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	assert.NoError(t, err)
+	sshIdentity, err := agessh.NewEd25519Identity(privateKey)
+	assert.NoError(t, err)
+
+	recipients, err := ParseRecipients(strings.NewReader("# team\n" +
+		identity.Recipient().String() + "\n\n" +
+		string(ssh.MarshalAuthorizedKey(sshPublicKey))))
+	assert.NoError(t, err)
+	assert.Len(t, recipients, 2)
+
+	encoded, err := New(WithRecipients(recipients...)).Encode([]byte("secret"))
+	assert.NoError(t, err)
+	assert.True(t, IsEncrypted(encoded))
+	assert.True(t, strings.HasPrefix(string(encoded), "-----BEGIN AGE ENCRYPTED FILE-----"))
+	assert.False(t, IsEncrypted([]byte("secret")))
+
+	identities, err := ParseIdentities([]byte(identity.String() + "\n"))
+	assert.NoError(t, err)
+	for _, codec := range []*Codec{New(WithIdentities(identities...)), New(WithIdentities(sshIdentity))} {
+		decoded, err := codec.Decode(encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("secret"), decoded)
+	}
+
+	other, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	_, err = New(WithIdentities(other)).Decode(encoded)
+	assert.Error(t, err)
+
+	_, err = New().Encode([]byte("secret"))
+	assert.Error(t, err)
+	_, err = ParseRecipients(strings.NewReader("age1invalid\n"))
+	assert.Error(t, err)
+}
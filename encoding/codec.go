@@ -0,0 +1,91 @@
+package encoding
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+// Identity stores values as they are.
+type Identity struct{}
+
+func (Identity) Encode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (Identity) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// Gzip compresses values with gzip.
+type Gzip struct{}
+
+func (Gzip) Encode(data []byte) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	gzWriter := gzip.NewWriter(buffer)
+	if _, err := gzWriter.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gzWriter.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (Gzip) Decode(data []byte) ([]byte, error) {
+	gzReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gzReader.Close()
+	return ioutil.ReadAll(gzReader)
+}
+
+// Detect reports whether data starts with the gzip magic number.
+func (Gzip) Detect(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x1f, 0x8b})
+}
+
+// Chain applies codecs in order when encoding and in reverse order when
+// decoding, e.g. Chain(Gzip{}, encrypt) compresses values before they are
+// encrypted.
+func Chain(codecs ...Codec) Codec {
+	if len(codecs) == 1 {
+		return codecs[0]
+	}
+	return chain(codecs)
+}
+
+type chain []Codec
+
+func (c chain) Encode(data []byte) ([]byte, error) {
+	for _, codec := range c {
+		var err error
+		if data, err = codec.Encode(data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func (c chain) Decode(data []byte) ([]byte, error) {
+	for i := len(c) - 1; i >= 0; i-- {
+		var err error
+		if data, err = c[i].Decode(data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// Detect asks the last codec of the chain, which produced the stored
+// value. A chain whose last codec is no Detector detects every value.
+func (c chain) Detect(data []byte) bool {
+	if len(c) == 0 {
+		return true
+	}
+	if detector, ok := c[len(c)-1].(Detector); ok {
+		return detector.Detect(data)
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package encoding
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// reverse is a codec for tests which reverses values.
+type reverse struct{}
+
+func (reverse) Encode(data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[len(data)-1-i] = b
+	}
+	return out, nil
+}
+
+func (r reverse) Decode(data []byte) ([]byte, error) {
+	return r.Encode(data)
+}
+
+func TestChain(t *testing.T) {
+	codec := Chain(reverse{}, Gzip{})
+	encoded, err := codec.Encode([]byte("config"))
+	assert.NoError(t, err)
+	assert.True(t, codec.(Detector).Detect(encoded))
+	assert.False(t, codec.(Detector).Detect([]byte("config")))
+
+	decoded, err := Gzip{}.Decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("gifnoc"), decoded)
+
+	decoded, err = codec.Decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("config"), decoded)
+
+	assert.Equal(t, Identity{}, Chain(Identity{}))
+	decoded, err = Chain(Identity{}, reverse{}).Decode([]byte("gifnoc"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("config"), decoded)
+}
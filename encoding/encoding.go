@@ -0,0 +1,16 @@
+// Package encoding defines the codecs values are encoded with before they
+// are stored in a backend.
+package encoding
+
+// Codec encodes values before they are stored and decodes them after they
+// are read.
+type Codec interface {
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+// Detector is implemented by codecs which recognize the values they
+// encoded, so values of several codecs can be told apart.
+type Detector interface {
+	Detect(data []byte) bool
+}
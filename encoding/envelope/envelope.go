@@ -0,0 +1,224 @@
+// Package envelope implements envelope encryption: every value is
+// encrypted with its own AES-256-GCM data key, which is stored next to it
+// wrapped by a key-encryption key (KEK). The format is
+//
+//	header base64(len(wrapped key) wrapped key nonce gcm(data))
+//
+// with an encoding.Header naming the codec "envelope" and the id of the
+// KEK. Rotating the KEK only rewraps the data keys, see Codec.Rewrap.
+package envelope
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/GGXXLL/crypt/encoding"
+)
+
+// Name is the codec name of envelope values in their header.
+const Name = "envelope"
+
+const dataKeySize = 32
+
+// additionalData binds the ciphertext to this format and to the codec and
+// the compressed flag of its header, so the flag can't be flipped. The id
+// of the KEK is left out, so data keys can be rewrapped without touching
+// the payload.
+func additionalData(codec string, compressed bool) []byte {
+	ad := "crypt envelope v1;" + codec + ";"
+	if compressed {
+		ad += "z"
+	}
+	return []byte(ad)
+}
+
+// KeyWrapper wraps data keys with a key-encryption key.
+type KeyWrapper interface {
+	// KeyID identifies the KEK. It is stored in the header of values and
+	// must not contain ';' or newlines.
+	KeyID() string
+	WrapKey(dataKey []byte) ([]byte, error)
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// Codec encrypts values with fresh data keys wrapped by its KEK.
+type Codec struct {
+	kek      KeyWrapper
+	wrappers map[string]KeyWrapper
+	compress bool
+}
+
+type OptionFunc func(c *Codec)
+
+// WithPreviousKeys adds KEKs which only unwrap the data keys of values
+// stored before the KEK was rotated.
+func WithPreviousKeys(wrappers ...KeyWrapper) OptionFunc {
+	return func(c *Codec) {
+		for _, w := range wrappers {
+			if _, ok := c.wrappers[w.KeyID()]; !ok {
+				c.wrappers[w.KeyID()] = w
+			}
+		}
+	}
+}
+
+// WithCompression compresses values with gzip before they are encrypted.
+func WithCompression() OptionFunc {
+	return func(c *Codec) {
+		c.compress = true
+	}
+}
+
+// New creates a codec wrapping the data keys of new values with kek. It
+// fails if the id of kek or of a previous key can't be stored in a header.
+func New(kek KeyWrapper, opts ...OptionFunc) (*Codec, error) {
+	c := &Codec{kek: kek, wrappers: map[string]KeyWrapper{kek.KeyID(): kek}}
+	for _, opt := range opts {
+		opt(c)
+	}
+	for id := range c.wrappers {
+		if strings.ContainsAny(id, ";\r\n") {
+			return nil, fmt.Errorf("envelope: invalid key id %q, it must not contain ';' or newlines", id)
+		}
+	}
+	return c, nil
+}
+
+func (c *Codec) Encode(data []byte) ([]byte, error) {
+	if c.compress {
+		var err error
+		if data, err = (encoding.Gzip{}).Encode(data); err != nil {
+			return nil, err
+		}
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	wrapped, err := c.kek.WrapKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, data, additionalData(Name, c.compress))
+	return c.marshal(c.kek.KeyID(), wrapped, sealed, c.compress)
+}
+
+func (c *Codec) Decode(data []byte) ([]byte, error) {
+	header, wrapped, sealed, err := unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := c.unwrap(header.KeyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("envelope: value too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData(header.Codec, header.Compressed))
+	if err != nil {
+		return nil, fmt.Errorf("envelope: decrypting value: %v", err)
+	}
+	if header.Compressed {
+		return (encoding.Gzip{}).Decode(plaintext)
+	}
+	return plaintext, nil
+}
+
+// Detect reports whether data has an envelope header.
+func (c *Codec) Detect(data []byte) bool {
+	header, _, err := encoding.ParseHeader(data)
+	return err == nil && header != nil && header.Codec == Name
+}
+
+// Rewrap returns data with its data key wrapped by the current KEK. The
+// encrypted payload is kept as it is. Values already wrapped by the
+// current KEK are returned unchanged.
+func (c *Codec) Rewrap(data []byte) ([]byte, error) {
+	header, wrapped, sealed, err := unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if header.KeyID == c.kek.KeyID() {
+		return data, nil
+	}
+	dataKey, err := c.unwrap(header.KeyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if wrapped, err = c.kek.WrapKey(dataKey); err != nil {
+		return nil, err
+	}
+	return c.marshal(c.kek.KeyID(), wrapped, sealed, header.Compressed)
+}
+
+func (c *Codec) unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	wrapper, ok := c.wrappers[keyID]
+	if !ok {
+		return nil, fmt.Errorf("envelope: unknown key-encryption key %s", keyID)
+	}
+	dataKey, err := wrapper.UnwrapKey(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: unwrapping data key with %s: %v", keyID, err)
+	}
+	return dataKey, nil
+}
+
+func (c *Codec) marshal(keyID string, wrapped, sealed []byte, compressed bool) ([]byte, error) {
+	if len(wrapped) > 0xffff {
+		return nil, errors.New("envelope: wrapped data key too long")
+	}
+	raw := make([]byte, 2, 2+len(wrapped)+len(sealed))
+	binary.BigEndian.PutUint16(raw, uint16(len(wrapped)))
+	raw = append(append(raw, wrapped...), sealed...)
+	header := &encoding.Header{Codec: Name, KeyID: keyID, Compressed: compressed}
+	return header.Prepend([]byte(base64.StdEncoding.EncodeToString(raw))), nil
+}
+
+func unmarshal(data []byte) (*encoding.Header, []byte, []byte, error) {
+	header, payload, err := encoding.ParseHeader(data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if header == nil || header.Codec != Name {
+		return nil, nil, nil, errors.New("envelope: value is not envelope encrypted")
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(payload)))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(raw) < 2 || len(raw) < 2+int(binary.BigEndian.Uint16(raw)) {
+		return nil, nil, nil, errors.New("envelope: value too short")
+	}
+	n := 2 + int(binary.BigEndian.Uint16(raw))
+	return header, raw[2:n], raw[n:], nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,124 @@
+package envelope
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GGXXLL/crypt/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodec(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kek")
+	kek, err := GenerateFileKEK(path)
+	assert.NoError(t, err)
+	_, err = GenerateFileKEK(path)
+	assert.Error(t, err)
+	loaded, err := LoadFileKEK(path)
+	assert.NoError(t, err)
+	assert.Equal(t, kek.KeyID(), loaded.KeyID())
+
+	codec := newCodec(t, kek, WithCompression())
+	encoded, err := codec.Encode([]byte("secret"))
+	assert.NoError(t, err)
+	assert.True(t, codec.Detect(encoded))
+	assert.False(t, codec.Detect([]byte("secret")))
+	header, _, err := encoding.ParseHeader(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, &encoding.Header{Codec: Name, KeyID: kek.KeyID(), Compressed: true}, header)
+
+	decoded, err := newCodec(t, loaded).Decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), decoded)
+
+	// every value has its own data key.
+	again, err := codec.Encode([]byte("secret"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, encoded, again)
+
+	tampered := []byte(strings.Replace(string(encoded), "\n", "\nA", 1))
+	_, err = codec.Decode(tampered)
+	assert.Error(t, err)
+
+	// the compressed flag is authenticated.
+	_, payload, err := encoding.ParseHeader(encoded)
+	assert.NoError(t, err)
+	flipped := (&encoding.Header{Codec: Name, KeyID: kek.KeyID()}).Prepend(payload)
+	_, err = codec.Decode(flipped)
+	assert.Error(t, err)
+}
+
+func TestRewrap(t *testing.T) {
+	oldKEK, err := NewFileKEK(make([]byte, 32))
+	assert.NoError(t, err)
+	newKEK, err := GenerateFileKEK(filepath.Join(t.TempDir(), "kek"))
+	assert.NoError(t, err)
+
+	encoded, err := newCodec(t, oldKEK).Encode([]byte("secret"))
+	assert.NoError(t, err)
+
+	codec := newCodec(t, newKEK, WithPreviousKeys(oldKEK))
+	decoded, err := codec.Decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), decoded)
+
+	rewrapped, err := codec.Rewrap(encoded)
+	assert.NoError(t, err)
+	header, _, err := encoding.ParseHeader(rewrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, newKEK.KeyID(), header.KeyID)
+
+	// the payload is kept, only the data key is wrapped again.
+	_, _, sealed, err := unmarshal(encoded)
+	assert.NoError(t, err)
+	_, _, resealed, err := unmarshal(rewrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, sealed, resealed)
+
+	decoded, err = newCodec(t, newKEK).Decode(rewrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), decoded)
+	_, err = newCodec(t, newKEK).Decode(encoded)
+	assert.Error(t, err)
+}
+
+func TestKMS(t *testing.T) {
+	local, err := NewFileKEK(make([]byte, 32))
+	assert.NoError(t, err)
+	var calls []string
+	kms := &KMS{
+		ID: "arn:aws:kms:eu-west-1:111122223333:key/crypt",
+		Encrypt: func(_ context.Context, keyID string, plaintext []byte) ([]byte, error) {
+			calls = append(calls, "encrypt "+keyID)
+			return local.WrapKey(plaintext)
+		},
+		Decrypt: func(_ context.Context, keyID string, ciphertext []byte) ([]byte, error) {
+			calls = append(calls, "decrypt "+keyID)
+			return local.UnwrapKey(ciphertext)
+		},
+	}
+	codec := newCodec(t, kms)
+	encoded, err := codec.Encode([]byte("secret"))
+	assert.NoError(t, err)
+	decoded, err := codec.Decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), decoded)
+	assert.Equal(t, []string{"encrypt " + kms.ID, "decrypt " + kms.ID}, calls)
+}
+
+func newCodec(t *testing.T, kek KeyWrapper, opts ...OptionFunc) *Codec {
+	codec, err := New(kek, opts...)
+	assert.NoError(t, err)
+	return codec
+}
+
+func TestInvalidKeyID(t *testing.T) {
+	kek, err := NewFileKEK(make([]byte, 32))
+	assert.NoError(t, err)
+	_, err = New(&KMS{ID: "key;z"})
+	assert.Error(t, err)
+	_, err = New(kek, WithPreviousKeys(&KMS{ID: "key\n"}))
+	assert.Error(t, err)
+}
@@ -0,0 +1,130 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// FileKEK is a key-encryption key kept locally, usually in a file only the
+// application can read. Data keys are wrapped with AES-256-GCM.
+type FileKEK struct {
+	id  string
+	key []byte
+}
+
+// NewFileKEK creates a KEK of the 32 byte key. Its id is derived from the
+// key.
+func NewFileKEK(key []byte) (*FileKEK, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("envelope: key-encryption key must be %d bytes, not %d", dataKeySize, len(key))
+	}
+	sum := sha256.Sum256(key)
+	return &FileKEK{id: "file:" + hex.EncodeToString(sum[:8]), key: key}, nil
+}
+
+// LoadFileKEK reads a base64 encoded key from path.
+func LoadFileKEK(path string) (*FileKEK, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, fmt.Errorf("envelope: reading key-encryption key %s: %v", path, err)
+	}
+	return NewFileKEK(key)
+}
+
+// GenerateFileKEK writes a new random key to path, which must not exist
+// yet.
+func GenerateFileKEK(path string) (*FileKEK, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return NewFileKEK(key)
+}
+
+func (k *FileKEK) KeyID() string {
+	return k.id
+}
+
+func (k *FileKEK) WrapKey(dataKey []byte) ([]byte, error) {
+	aead, err := newGCM(k.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(k.id)), nil
+}
+
+func (k *FileKEK) UnwrapKey(wrapped []byte) ([]byte, error) {
+	aead, err := newGCM(k.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped data key too short")
+	}
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(k.id))
+}
+
+// KMS wraps data keys with a key managed by a cloud KMS. Encrypt and
+// Decrypt are hooks calling the KMS, e.g. the Encrypt and Decrypt APIs of
+// AWS KMS or Google Cloud KMS, so crypt does not depend on their SDKs.
+type KMS struct {
+	// ID identifies the key within the KMS, e.g. its ARN or resource name.
+	ID      string
+	Encrypt func(ctx context.Context, keyID string, plaintext []byte) ([]byte, error)
+	Decrypt func(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error)
+	// Timeout limits each call, 30s if zero.
+	Timeout time.Duration
+}
+
+func (k *KMS) KeyID() string {
+	return k.ID
+}
+
+func (k *KMS) WrapKey(dataKey []byte) ([]byte, error) {
+	ctx, cancel := k.context()
+	defer cancel()
+	return k.Encrypt(ctx, k.ID, dataKey)
+}
+
+func (k *KMS) UnwrapKey(wrapped []byte) ([]byte, error) {
+	ctx, cancel := k.context()
+	defer cancel()
+	return k.Decrypt(ctx, k.ID, wrapped)
+}
+
+func (k *KMS) context() (context.Context, context.CancelFunc) {
+	timeout := k.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
@@ -0,0 +1,80 @@
+package encoding
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// HeaderMagic starts every value carrying a Header. It is followed by the
+// version of the header format.
+const HeaderMagic = "CRYPT"
+
+// HeaderVersion is the version of the header format written by Header.
+const HeaderVersion = 1
+
+// Flags of a header.
+const (
+	compressedFlag = "z"
+	signedFlag     = "s"
+)
+
+// Header describes how the value following it was encoded, so readers can
+// tell encoded values from plain ones and pick the right codec and key. It
+// is written as a single line in front of the payload:
+//
+//	CRYPT1;<codec>;<key ids>;<flags>\n<payload>
+type Header struct {
+	// Codec names the codec of the payload, e.g. "secconf".
+	Codec string
+	// KeyID identifies the keys the payload is encrypted for, if any.
+	KeyID string
+	// Compressed is set if the payload was compressed before encoding.
+	Compressed bool
+	// Signed is set if the payload carries a signature.
+	Signed bool
+}
+
+// Prepend returns payload with the header in front of it.
+func (h *Header) Prepend(payload []byte) []byte {
+	var flags []string
+	if h.Compressed {
+		flags = append(flags, compressedFlag)
+	}
+	if h.Signed {
+		flags = append(flags, signedFlag)
+	}
+	line := fmt.Sprintf("%s%d;%s;%s;%s\n", HeaderMagic, HeaderVersion, h.Codec, h.KeyID, strings.Join(flags, ","))
+	return append([]byte(line), payload...)
+}
+
+// ParseHeader splits data into its header and payload. Values without a
+// header, like those stored before headers existed, are returned as they
+// are with a nil header. So are values starting with a header line of an
+// unknown version or format, which are most likely plain values starting
+// with the magic by chance; the codec decoding them rejects them if not.
+func ParseHeader(data []byte) (*Header, []byte, error) {
+	if !bytes.HasPrefix(data, []byte(HeaderMagic)) {
+		return nil, data, nil
+	}
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		return nil, data, nil
+	}
+	fields := strings.Split(string(data[len(HeaderMagic):end]), ";")
+	version, err := strconv.Atoi(fields[0])
+	if err != nil || version != HeaderVersion || len(fields) != 4 {
+		return nil, data, nil
+	}
+	h := &Header{Codec: fields[1], KeyID: fields[2]}
+	for _, flag := range strings.Split(fields[3], ",") {
+		switch flag {
+		case compressedFlag:
+			h.Compressed = true
+		case signedFlag:
+			h.Signed = true
+		}
+	}
+	return h, data[end+1:], nil
+}
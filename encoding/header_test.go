@@ -0,0 +1,31 @@
+package encoding
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeader(t *testing.T) {
+	h := &Header{Codec: "secconf", KeyID: "3C4F298184800DB2", Compressed: true}
+	data := h.Prepend([]byte("payload"))
+	assert.Equal(t, "CRYPT1;secconf;3C4F298184800DB2;z\npayload", string(data))
+
+	parsed, payload, err := ParseHeader(data)
+	assert.NoError(t, err)
+	assert.Equal(t, h, parsed)
+	assert.Equal(t, []byte("payload"), payload)
+
+	h = &Header{Codec: "secconf-signed", KeyID: "3C4F298184800DB2", Compressed: true, Signed: true}
+	parsed, _, err = ParseHeader(h.Prepend(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, h, parsed)
+
+	// values without header are returned as they are.
+	for _, legacy := range []string{"payload", "CRYPTIC\nvalue", "CRYPT1", "CRYPT2;secconf;;\npayload", "CRYPT1;secconf\npayload"} {
+		parsed, payload, err = ParseHeader([]byte(legacy))
+		assert.NoError(t, err)
+		assert.Nil(t, parsed)
+		assert.Equal(t, []byte(legacy), payload)
+	}
+}
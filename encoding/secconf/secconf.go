@@ -1,41 +1,70 @@
 // Package secconf implements secconf encoding as specified in the following
 // format:
 //
-//   base64(gpg(gzip(data)))
+//	header base64(gpg(gzip(data)))
 //
+// The header is an encoding.Header naming the codec "secconf" and the key
+// ids of the recipients. Values written before headers existed have none
+// and are still decoded.
+//
+// Values may be signed when they are encrypted, or only signed for
+// configuration which is not secret but must not be tampered with. Signed
+// values are flagged in their header; sign-only values name the codec
+// "secconf-signed" and the key id of the signer.
 package secconf
 
 import (
 	"bytes"
 	"compress/gzip"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"strings"
 
+	"github.com/GGXXLL/crypt/encoding"
 	"golang.org/x/crypto/openpgp"
 )
 
+const (
+	// Name is the codec name of secconf values in their header.
+	Name = "secconf"
+	// SignedName is the codec name of sign-only values in their header.
+	SignedName = "secconf-signed"
+)
+
 // Deocde decodes data using the secconf codec.
 func Decode(data []byte, secertKeyring io.Reader) ([]byte, error) {
-	decoder := base64.NewDecoder(base64.StdEncoding, bytes.NewBuffer(data))
 	entityList, err := openpgp.ReadArmoredKeyRing(secertKeyring)
 	if err != nil {
 		return nil, err
 	}
-	md, err := openpgp.ReadMessage(decoder, entityList, nil, nil)
+	return decode(data, entityList, nil)
+}
+
+// DecodeVerified decodes data like Decode and fails unless it is signed by
+// a key of trustedKeyring.
+func DecodeVerified(data []byte, secretKeyring, trustedKeyring io.Reader) ([]byte, error) {
+	entityList, err := openpgp.ReadArmoredKeyRing(secretKeyring)
 	if err != nil {
 		return nil, err
 	}
-	gzReader, err := gzip.NewReader(md.UnverifiedBody)
+	trusted, err := openpgp.ReadArmoredKeyRing(trustedKeyring)
 	if err != nil {
 		return nil, err
 	}
-	defer gzReader.Close()
-	byts, err := ioutil.ReadAll(gzReader)
+	return decode(data, entityList, trusted)
+}
+
+// Verify returns the content of the sign-only value data if it is signed
+// by a key of trustedKeyring.
+func Verify(data []byte, trustedKeyring io.Reader) ([]byte, error) {
+	trusted, err := openpgp.ReadArmoredKeyRing(trustedKeyring)
 	if err != nil {
 		return nil, err
 	}
-	return byts, nil
+	return decode(data, nil, trusted)
 }
 
 // Encode encodes data to a base64 encoded using the secconf codec.
@@ -45,9 +74,48 @@ func Encode(data []byte, keyring io.Reader) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return encode(data, entityList, nil)
+}
+
+// EncodeSigned encodes data like Encode and signs it with the first
+// private key found in signerKeyring.
+func EncodeSigned(data []byte, keyring, signerKeyring io.Reader) ([]byte, error) {
+	entityList, err := openpgp.ReadArmoredKeyRing(keyring)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := readSigner(signerKeyring)
+	if err != nil {
+		return nil, err
+	}
+	return encode(data, entityList, signer)
+}
+
+// Sign signs data with the first private key found in signerKeyring
+// without encrypting it.
+func Sign(data []byte, signerKeyring io.Reader) ([]byte, error) {
+	signer, err := readSigner(signerKeyring)
+	if err != nil {
+		return nil, err
+	}
+	return encode(data, nil, signer)
+}
+
+// encode encrypts data for the recipients to and signs it if signer is
+// set. Without recipients data is only signed.
+func encode(data []byte, to openpgp.EntityList, signer *openpgp.Entity) ([]byte, error) {
+	header := &encoding.Header{Codec: Name, KeyID: keyIDs(to), Compressed: true, Signed: signer != nil}
 	buffer := new(bytes.Buffer)
 	encoder := base64.NewEncoder(base64.StdEncoding, buffer)
-	pgpWriter, err := openpgp.Encrypt(encoder, entityList, nil, nil, nil)
+	var pgpWriter io.WriteCloser
+	var err error
+	if len(to) == 0 {
+		header.Codec = SignedName
+		header.KeyID = signer.PrimaryKey.KeyIdString()
+		pgpWriter, err = openpgp.Sign(encoder, signer, nil, nil)
+	} else {
+		pgpWriter, err = openpgp.Encrypt(encoder, to, signer, nil, nil)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -64,5 +132,189 @@ func Encode(data []byte, keyring io.Reader) ([]byte, error) {
 	if err := encoder.Close(); err != nil {
 		return nil, err
 	}
-	return buffer.Bytes(), nil
+	return header.Prepend(buffer.Bytes()), nil
+}
+
+// decode decrypts data with the keys of keyring. If trusted is set, data
+// has to be signed by one of its keys.
+func decode(data []byte, keyring, trusted openpgp.EntityList) ([]byte, error) {
+	header, payload, err := encoding.ParseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil && header.Codec != Name && header.Codec != SignedName {
+		return nil, fmt.Errorf("secconf: value is encoded with %s", header.Codec)
+	}
+	// only values with a header are signed, the signature is still checked
+	// below.
+	if trusted != nil && (header == nil || !header.Signed) {
+		return nil, errors.New("secconf: value is not signed")
+	}
+	decoder := base64.NewDecoder(base64.StdEncoding, bytes.NewBuffer(payload))
+	keys := make(openpgp.EntityList, 0, len(keyring)+len(trusted))
+	keys = append(append(keys, keyring...), trusted...)
+	md, err := openpgp.ReadMessage(decoder, keys, nil, nil)
+	if err != nil {
+		if header != nil && header.Codec == Name && header.KeyID != "" {
+			return nil, fmt.Errorf("secconf: decrypting value for key %s: %v", header.KeyID, err)
+		}
+		return nil, err
+	}
+	// the signature is checked once the whole body was read.
+	body, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, err
+	}
+	if trusted != nil {
+		if err := verify(md, trusted); err != nil {
+			return nil, err
+		}
+	}
+	if header != nil && !header.Compressed {
+		return body, nil
+	}
+	gzReader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer gzReader.Close()
+	byts, err := ioutil.ReadAll(gzReader)
+	if err != nil {
+		return nil, err
+	}
+	return byts, nil
+}
+
+// verify checks that the message of md, which has been read, carries a
+// valid signature of a key of trusted.
+func verify(md *openpgp.MessageDetails, trusted openpgp.EntityList) error {
+	if !md.IsSigned {
+		return errors.New("secconf: value is not signed")
+	}
+	if md.SignedBy == nil || len(trusted.KeysById(md.SignedByKeyId)) == 0 {
+		return fmt.Errorf("secconf: value is signed by untrusted key %016X", md.SignedByKeyId)
+	}
+	if md.SignatureError != nil {
+		return fmt.Errorf("secconf: invalid signature: %v", md.SignatureError)
+	}
+	return nil
+}
+
+// readSigner returns the first entity of keyring with a usable private key.
+func readSigner(keyring io.Reader) (*openpgp.Entity, error) {
+	entityList, err := openpgp.ReadArmoredKeyRing(keyring)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entityList {
+		if e.PrivateKey == nil {
+			continue
+		}
+		if e.PrivateKey.Encrypted {
+			return nil, fmt.Errorf("secconf: signing key %s is encrypted", e.PrimaryKey.KeyIdString())
+		}
+		return e, nil
+	}
+	return nil, errors.New("secconf: no private key to sign with")
+}
+
+// keyIDs returns the ids of the primary keys of entities, separated by
+// commas.
+func keyIDs(entities openpgp.EntityList) string {
+	ids := make([]string, 0, len(entities))
+	for _, e := range entities {
+		ids = append(ids, e.PrimaryKey.KeyIdString())
+	}
+	return strings.Join(ids, ",")
+}
+
+// Codec encodes values with secconf. Its armored keyring needs the public
+// keys of the recipients to encode and a secret key to decode.
+type Codec struct {
+	keyring  []byte
+	signer   []byte
+	trusted  []byte
+	signOnly bool
+}
+
+type OptionFunc func(c *Codec)
+
+// WithSigner signs encoded values with the first private key of the
+// armored keyring signer.
+func WithSigner(signer []byte) OptionFunc {
+	return func(c *Codec) {
+		c.signer = signer
+	}
+}
+
+// WithTrustedSigners makes Decode fail for values which are not signed by
+// a key of the armored keyring trusted, including unsigned ones.
+func WithTrustedSigners(trusted []byte) OptionFunc {
+	return func(c *Codec) {
+		c.trusted = trusted
+	}
+}
+
+// WithSignOnly signs values without encrypting them. It needs WithSigner
+// to encode.
+func WithSignOnly() OptionFunc {
+	return func(c *Codec) {
+		c.signOnly = true
+	}
+}
+
+func NewCodec(keyring []byte, opts ...OptionFunc) *Codec {
+	c := &Codec{keyring: keyring}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *Codec) Encode(data []byte) ([]byte, error) {
+	switch {
+	case c.signOnly && c.signer == nil:
+		return nil, errors.New("secconf: no signer for sign-only values")
+	case c.signOnly:
+		return Sign(data, bytes.NewReader(c.signer))
+	case c.signer != nil:
+		return EncodeSigned(data, bytes.NewReader(c.keyring), bytes.NewReader(c.signer))
+	default:
+		return Encode(data, bytes.NewReader(c.keyring))
+	}
+}
+
+func (c *Codec) Decode(data []byte) ([]byte, error) {
+	var keyring, trusted openpgp.EntityList
+	var err error
+	if len(c.keyring) > 0 {
+		if keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(c.keyring)); err != nil {
+			return nil, err
+		}
+	}
+	if c.trusted != nil {
+		if trusted, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(c.trusted)); err != nil {
+			return nil, err
+		}
+	}
+	return decode(data, keyring, trusted)
+}
+
+// Detect reports whether data has a secconf header or, for values without
+// header, looks like secconf: base64 of an OpenPGP message starting with a
+// public-key encrypted session key packet.
+func (c *Codec) Detect(data []byte) bool {
+	header, payload, err := encoding.ParseHeader(data)
+	if err != nil {
+		return false
+	}
+	if header != nil {
+		return header.Codec == Name || header.Codec == SignedName
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(payload))
+	if err != nil || len(raw) == 0 {
+		return false
+	}
+	// the packet tag 1 in the old and the new packet format
+	return raw[0]&0xfc == 0x84 || raw[0] == 0xc1
 }
@@ -2,7 +2,13 @@ package secconf
 
 import (
 	"bytes"
+	"encoding/base64"
+	"strings"
 	"testing"
+
+	"github.com/GGXXLL/crypt/encoding"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
 )
 
 var encodingTests = []struct {
@@ -26,3 +32,158 @@ func TestEncoding(t *testing.T) {
 		}
 	}
 }
+
+func TestCodec(t *testing.T) {
+	encoded, err := NewCodec([]byte(pubring)).Encode([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := NewCodec([]byte(secring))
+	if !codec.Detect(encoded) {
+		t.Errorf("secconf value not detected")
+	}
+	if codec.Detect([]byte("secret")) {
+		t.Errorf("plain value detected")
+	}
+	decoded, err := codec.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != "secret" {
+		t.Errorf("want secret, got %s", decoded)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	encoded, err := Encode([]byte("secret"), bytes.NewBufferString(pubring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, payload, err := encoding.ParseHeader(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header == nil || header.Codec != Name || header.KeyID == "" || !header.Compressed {
+		t.Fatalf("unexpected header %+v", header)
+	}
+
+	// values written before headers existed are still decoded.
+	decoded, err := Decode(payload, bytes.NewBufferString(secring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != "secret" {
+		t.Errorf("want secret, got %s", decoded)
+	}
+
+	other := (&encoding.Header{Codec: "age"}).Prepend(payload)
+	if _, err := Decode(other, bytes.NewBufferString(secring)); err == nil || !strings.Contains(err.Error(), "age") {
+		t.Errorf("want codec error, got %v", err)
+	}
+}
+
+// otherSigner returns the armored keyring of a new key which is not
+// trusted.
+func otherSigner(t *testing.T) []byte {
+	e, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	w, err := armor.Encode(buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSigned(t *testing.T) {
+	encoded, err := EncodeSigned([]byte("secret"), bytes.NewBufferString(pubring), bytes.NewBufferString(secring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _, err := encoding.ParseHeader(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header == nil || header.Codec != Name || !header.Signed {
+		t.Fatalf("unexpected header %+v", header)
+	}
+	decoded, err := DecodeVerified(encoded, bytes.NewBufferString(secring), bytes.NewBufferString(pubring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != "secret" {
+		t.Errorf("want secret, got %s", decoded)
+	}
+
+	unsigned, err := Encode([]byte("secret"), bytes.NewBufferString(pubring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeVerified(unsigned, bytes.NewBufferString(secring), bytes.NewBufferString(pubring)); err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Errorf("want unsigned error, got %v", err)
+	}
+
+	untrusted, err := EncodeSigned([]byte("secret"), bytes.NewBufferString(pubring), bytes.NewReader(otherSigner(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeVerified(untrusted, bytes.NewBufferString(secring), bytes.NewBufferString(pubring)); err == nil || !strings.Contains(err.Error(), "untrusted") {
+		t.Errorf("want untrusted error, got %v", err)
+	}
+	// without trusted signers the signature is not required.
+	if _, err := Decode(untrusted, bytes.NewBufferString(secring)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSignOnly(t *testing.T) {
+	codec := NewCodec(nil, WithSigner([]byte(secring)), WithTrustedSigners([]byte(pubring)), WithSignOnly())
+	encoded, err := codec.Encode([]byte("config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _, err := encoding.ParseHeader(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header == nil || header.Codec != SignedName || !header.Signed || header.KeyID == "" {
+		t.Fatalf("unexpected header %+v", header)
+	}
+	if !codec.Detect(encoded) {
+		t.Errorf("signed value not detected")
+	}
+	decoded, err := codec.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != "config" {
+		t.Errorf("want config, got %s", decoded)
+	}
+
+	// tampering with the content breaks the signature.
+	_, payload, _ := encoding.ParseHeader(encoded)
+	raw, err := base64.StdEncoding.DecodeString(string(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)/2] ^= 0xff
+	tampered := header.Prepend([]byte(base64.StdEncoding.EncodeToString(raw)))
+	if _, err := codec.Decode(tampered); err == nil {
+		t.Errorf("tampered value decoded")
+	}
+
+	if _, err := Verify(encoded, bytes.NewReader(otherSigner(t))); err == nil {
+		t.Errorf("value verified with untrusted keyring")
+	}
+	if _, err := NewCodec(nil, WithSignOnly()).Encode([]byte("config")); err == nil {
+		t.Errorf("sign-only value encoded without signer")
+	}
+}
@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig builds the client TLS configuration of a backend from PEM
+// files. The client certificate is only loaded if certFile is set, the
+// system roots are used if caFile is empty. It returns nil if no file is
+// set and insecure is false, meaning TLS is not used.
+func TLSConfig(certFile, keyFile, caFile string, insecure bool) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" && !insecure {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading CA certificates: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("loading CA certificates: no certificate found in " + caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
@@ -2,18 +2,75 @@ package internal
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"sync"
+	"time"
 
 	"github.com/GGXXLL/crypt/backend"
 )
 
+// Backoff returns the delay before the next retry given the previous one,
+// doubling it within the [min, max] range.
+func Backoff(prev, min, max time.Duration) time.Duration {
+	if prev < min {
+		return min
+	}
+	if next := prev * 2; next < max {
+		return next
+	}
+	return max
+}
+
+// Sleep waits for d and reports false if ctx is done first.
+func Sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func GenMD5(b []byte) []byte {
 	h := md5.New()
 	h.Write(b)
 	return h.Sum(nil)
 }
 
+// WatchPrefixCache compares list with the snapshot of key hashes held in
+// cache and sends an event for every key that was added, changed or removed
+// since the previous call. The cache is updated to reflect list.
+func WatchPrefixCache(cache map[string][]byte, list backend.KVPairs, eventChan chan *backend.Event) {
+	seen := make(map[string]struct{}, len(list))
+	for _, kv := range list {
+		seen[kv.Key] = struct{}{}
+		h := GenMD5(kv.Value)
+		if old, ok := cache[kv.Key]; ok && bytes.Equal(old, h) {
+			continue
+		}
+		cache[kv.Key] = h
+		eventChan <- &backend.Event{Type: backend.EventPut, Key: kv.Key, Value: kv.Value}
+	}
+	for key := range cache {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		delete(cache, key)
+		eventChan <- &backend.Event{Type: backend.EventDelete, Key: key}
+	}
+}
+
+// NewPrefixCache builds the initial snapshot of key hashes used by
+// WatchPrefixCache.
+func NewPrefixCache(list backend.KVPairs) map[string][]byte {
+	cache := make(map[string][]byte, len(list))
+	for _, kv := range list {
+		cache[kv.Key] = GenMD5(kv.Value)
+	}
+	return cache
+}
+
 func WatchCache(cache *sync.Map, key string, value []byte, respChan chan *backend.Response) {
 	if h, ok := cache.Load(key); ok {
 		if !bytes.Equal(GenMD5(value), h.([]byte)) {